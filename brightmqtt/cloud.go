@@ -0,0 +1,307 @@
+package brightmqtt
+
+// This file decodes the verbose message format Glow publish to their own
+// broker, e.g. on SMART/HILD/<DEVICE_ID>. Rather than named fields each meter
+// is a set of Zigbee Smart Energy clusters, keyed by cluster ID, attribute set
+// and attribute ID, with every value hex encoded:
+//
+// {
+//     "gid": "1234567890ab",
+//     "time": "1661408219",
+//     "elecMtr": {
+//         "0702": {
+//             "00": {"00": "00000049b9a5"},
+//             "03": {"00": "00", "01": "000001", "02": "0003e8", "07": "31303132..."},
+//             "04": {"00": "0001e1", "01": "000003", "30": "000023", "40": "000101"}
+//         }
+//     },
+//     "gasMtr": {
+//         "0702": {
+//             "00": {"00": "0000000437fe"},
+//             "03": {"00": "01", "01": "000001", "02": "0003e8", "07": "33333432..."}
+//         }
+//     }
+// }
+//
+// Only the metering cluster (0702) is decoded. Tariff information isn't part
+// of it, so meters decoded from this format have a zero Price, and the
+// readings DecodeCloud returns for them have none.
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	meteringCluster = "0702"
+
+	// Attribute sets within the metering cluster.
+	readingSet    = "00"
+	formattingSet = "03"
+	historicalSet = "04"
+
+	// Attributes within the reading information set.
+	summationDelivered = "00"
+	summationReceived  = "01"
+
+	// Attributes within the formatting set.
+	unitOfMeasure = "00"
+	multiplier    = "01"
+	divisor       = "02"
+	siteID        = "07"
+
+	// Attributes within the historical consumption set.
+	instantaneousDemand = "00"
+	dayConsumption      = "01"
+	weekConsumption     = "30"
+	monthConsumption    = "40"
+)
+
+// Units of measure used by the metering cluster, the remaining values are
+// not used by UK smart meters.
+var cloudUnits = map[string]string{
+	"00": "kWh",
+	"01": "m3",
+	"02": "ft3",
+}
+
+// CloudMsg is a message in the verbose format sent to Glow's own broker. A
+// single message carries both meters, either of which may be missing.
+type CloudMsg struct {
+	Gid     string     `json:"gid"`
+	Time    string     `json:"time"`
+	ElecMtr CloudMeter `json:"elecMtr"`
+	GasMtr  CloudMeter `json:"gasMtr"`
+}
+
+// CloudMeter holds the clusters reported for a single meter, keyed by
+// cluster ID, then attribute set, then attribute ID. Values are normally hex
+// strings, but are left untyped so unexpected clusters don't fail to parse.
+type CloudMeter map[string]map[string]map[string]interface{}
+
+// IsCloudMessage reports whether payload is in the verbose format sent to
+// Glow's own broker rather than the format sent to a local broker.
+func IsCloudMessage(payload []byte) bool {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &keys); err != nil {
+		return false
+	}
+	_, elec := keys["elecMtr"]
+	_, gas := keys["gasMtr"]
+	return elec || gas
+}
+
+// Timestamp returns the time the message was sent, or the zero time if it
+// was missing.
+func (m CloudMsg) Timestamp() (time.Time, error) {
+	if m.Time == "" {
+		return time.Time{}, nil
+	}
+	secs, err := strconv.ParseInt(m.Time, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: %w", m.Time, err)
+	}
+	return time.Unix(secs, 0).UTC(), nil
+}
+
+// Electricity decodes the electricity meter from the message. ok is false if
+// the message doesn't include one.
+func (m CloudMsg) Electricity() (meter ElectricityMeter, ok bool, err error) {
+	if m.ElecMtr[meteringCluster] == nil {
+		return meter, false, nil
+	}
+	c := m.ElecMtr.metering()
+
+	if meter.Timestamp, err = m.Timestamp(); err != nil {
+		return meter, false, err
+	}
+
+	units, err := c.units()
+	if err != nil {
+		return meter, false, err
+	}
+
+	imp := &meter.Energy.Import
+	imp.Units = units
+	if imp.Mpan, err = c.site(); err != nil {
+		return meter, false, err
+	}
+	if imp.Cumulative, err = c.scaled(readingSet, summationDelivered, false); err != nil {
+		return meter, false, err
+	}
+	if imp.Day, err = c.scaled(historicalSet, dayConsumption, false); err != nil {
+		return meter, false, err
+	}
+	if imp.Week, err = c.scaled(historicalSet, weekConsumption, false); err != nil {
+		return meter, false, err
+	}
+	if imp.Month, err = c.scaled(historicalSet, monthConsumption, false); err != nil {
+		return meter, false, err
+	}
+
+	meter.Energy.Export.Units = units
+	if meter.Energy.Export.Cumulative, err = c.scaled(readingSet, summationReceived, false); err != nil {
+		return meter, false, err
+	}
+
+	// Demand is reported in the meter's energy unit per hour, so kWh is kW.
+	meter.Power.Units = "kW"
+	if meter.Power.Value, err = c.scaled(historicalSet, instantaneousDemand, true); err != nil {
+		return meter, false, err
+	}
+
+	return meter, true, nil
+}
+
+// Gas decodes the gas meter from the message. ok is false if the message
+// doesn't include one. Depending on the meter its readings are either energy
+// or volume, and are decoded into the matching fields of GasImport.
+func (m CloudMsg) Gas() (meter GasMeter, ok bool, err error) {
+	if m.GasMtr[meteringCluster] == nil {
+		return meter, false, nil
+	}
+	c := m.GasMtr.metering()
+
+	if meter.Timestamp, err = m.Timestamp(); err != nil {
+		return meter, false, err
+	}
+
+	units, err := c.units()
+	if err != nil {
+		return meter, false, err
+	}
+
+	imp := &meter.Energy.Import
+	if imp.Mprn, err = c.site(); err != nil {
+		return meter, false, err
+	}
+
+	var cumulative, day, week, month float64
+	if cumulative, err = c.scaled(readingSet, summationDelivered, false); err != nil {
+		return meter, false, err
+	}
+	if day, err = c.scaled(historicalSet, dayConsumption, false); err != nil {
+		return meter, false, err
+	}
+	if week, err = c.scaled(historicalSet, weekConsumption, false); err != nil {
+		return meter, false, err
+	}
+	if month, err = c.scaled(historicalSet, monthConsumption, false); err != nil {
+		return meter, false, err
+	}
+
+	if units == "kWh" {
+		imp.Units = units
+		imp.Cumulative, imp.Day, imp.Week, imp.Month = cumulative, day, week, month
+	} else {
+		imp.Cumulativevolunits = units
+		imp.Dayweekmonthvolunits = units
+		imp.Cumulativevol, imp.Dayvol, imp.Weekvol, imp.Monthvol = cumulative, day, week, month
+	}
+
+	return meter, true, nil
+}
+
+// metering is the metering cluster of a single meter, keyed by attribute set
+// and attribute ID.
+type metering map[string]map[string]interface{}
+
+func (m CloudMeter) metering() metering {
+	return metering(m[meteringCluster])
+}
+
+// attr returns the raw hex string for an attribute, or an empty string if
+// the meter didn't report it.
+func (c metering) attr(set, id string) (string, error) {
+	v, ok := c[set][id]
+	if !ok || v == nil {
+		return "", nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("attribute %s%s: expected a hex string, got %v", set, id, v)
+	}
+	return s, nil
+}
+
+// unsigned returns an attribute as an unsigned integer, or def if it's missing.
+func (c metering) unsigned(set, id string, def uint64) (uint64, error) {
+	s, err := c.attr(set, id)
+	if err != nil || s == "" {
+		return def, err
+	}
+	v, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("attribute %s%s: %w", set, id, err)
+	}
+	return v, nil
+}
+
+// scaled returns an attribute with the meter's multiplier and divisor
+// applied. Signed attributes are two's complement in however many bytes the
+// value was sent with.
+func (c metering) scaled(set, id string, signed bool) (float64, error) {
+	s, err := c.attr(set, id)
+	if err != nil || s == "" {
+		return 0, err
+	}
+
+	raw, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("attribute %s%s: %w", set, id, err)
+	}
+
+	v := float64(raw)
+	if bits := uint(len(s) * 4); signed && bits < 64 && raw&(1<<(bits-1)) != 0 {
+		v = float64(int64(raw) - int64(1)<<bits)
+	}
+
+	mul, err := c.unsigned(formattingSet, multiplier, 1)
+	if err != nil {
+		return 0, err
+	}
+	div, err := c.unsigned(formattingSet, divisor, 1)
+	if err != nil {
+		return 0, err
+	}
+	if div == 0 {
+		div = 1
+	}
+
+	return v * float64(mul) / float64(div), nil
+}
+
+// units returns the unit of measure the meter reports in.
+func (c metering) units() (string, error) {
+	s, err := c.attr(formattingSet, unitOfMeasure)
+	if err != nil || s == "" {
+		return "kWh", err
+	}
+	// The top bit flags binary coded decimal formatting and doesn't change
+	// the unit.
+	v, err := strconv.ParseUint(s, 16, 8)
+	if err != nil {
+		return "", fmt.Errorf("unit of measure: %w", err)
+	}
+	units, ok := cloudUnits[fmt.Sprintf("%02x", v&0x7f)]
+	if !ok {
+		return "", fmt.Errorf("unsupported unit of measure %q", s)
+	}
+	return units, nil
+}
+
+// site returns the MPAN or MPRN, which is sent as hex encoded ASCII.
+func (c metering) site() (string, error) {
+	s, err := c.attr(formattingSet, siteID)
+	if err != nil || s == "" {
+		return "", err
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return "", fmt.Errorf("site ID: %w", err)
+	}
+	return string(b), nil
+}
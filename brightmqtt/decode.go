@@ -0,0 +1,321 @@
+package brightmqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Topics the dongle publishes to, glow/<DEVICE_ID>/SENSOR/electricitymeter,
+// glow/<DEVICE_ID>/SENSOR/gasmeter and glow/<DEVICE_ID>/STATE.
+const (
+	ElectricityTopic = "electricitymeter"
+	GasTopic         = "gasmeter"
+	SensorTopic      = "SENSOR"
+	StateTopic       = "STATE"
+)
+
+var (
+	// ErrUnknownTopic is returned for messages on a topic which doesn't
+	// carry a kind of message the decoder understands.
+	ErrUnknownTopic = errors.New("unknown topic")
+
+	// ErrMalformedJSON is returned for payloads which aren't valid JSON, or
+	// don't match the shape of the message.
+	ErrMalformedJSON = errors.New("malformed JSON")
+
+	// ErrMissingField is returned for messages without a field every
+	// firmware sends, such as a meter's cumulative reading.
+	ErrMissingField = errors.New("missing required field")
+
+	// ErrOutOfRange is returned for readings with a value which can't be
+	// right, such as a negative cumulative reading.
+	ErrOutOfRange = errors.New("value out of range")
+
+	// ErrCloudFormat is returned for messages in the verbose format sent to
+	// Glow's own broker which can't be decoded.
+	ErrCloudFormat = errors.New("invalid cloud message")
+)
+
+// numericFields are the fields which always hold a number, but which some
+// firmware sends as a string.
+var numericFields = map[string]bool{
+	"cumulative":     true,
+	"day":            true,
+	"week":           true,
+	"month":          true,
+	"cumulativevol":  true,
+	"dayvol":         true,
+	"weekvol":        true,
+	"monthvol":       true,
+	"value":          true,
+	"unitrate":       true,
+	"standingcharge": true,
+	"uptime":         true,
+	"rssi":           true,
+	"lqi":            true,
+}
+
+// Decode decodes a message sent by the dongle to a local broker, routing it
+// by topic. Units are normalised, so errors wrapping ErrUnknownUnit are
+// returned as well as the errors above.
+//
+// Firmware versions differ in what they send, so the decoder is lenient
+// about the shape of a message: numbers sent as strings are accepted, fields
+// it doesn't know are listed in the reading's UnknownFields rather than
+// failing the decode, and a missing price leaves the reading's Price nil
+// rather than zero. Readings with a value out of range are rejected with an
+// error wrapping ErrOutOfRange.
+func Decode(topic string, payload []byte) (Reading, error) {
+	device := DeviceID(topic)
+
+	var r Reading
+	switch {
+	case strings.HasSuffix(topic, ElectricityTopic):
+		var msg ElectricitysMsg
+		fields, unknown, err := decodeJSON(payload, &msg, "electricitymeter.energy.import.cumulative")
+		if err != nil {
+			return Reading{}, err
+		}
+		priced := hasPrice(fields, "electricitymeter.energy.import.price")
+		if r, err = electricityReading(device, msg.Electricitymeter, priced); err != nil {
+			return Reading{}, err
+		}
+		r.UnknownFields = unknown
+
+	case strings.HasSuffix(topic, GasTopic):
+		var msg GasMsg
+		// Some meters only report volume, leaving the energy to be
+		// calculated from it.
+		fields, unknown, err := decodeJSON(payload, &msg, "gasmeter.energy.import.cumulative|gasmeter.energy.import.cumulativevol")
+		if err != nil {
+			return Reading{}, err
+		}
+		priced := hasPrice(fields, "gasmeter.energy.import.price")
+		if r, err = gasReading(device, msg.Gasmeter, priced); err != nil {
+			return Reading{}, err
+		}
+		r.UnknownFields = unknown
+
+	case strings.HasSuffix(topic, StateTopic):
+		var msg StateMsg
+		_, unknown, err := decodeJSON(payload, &msg)
+		if err != nil {
+			return Reading{}, err
+		}
+		r = Reading{Kind: KindState, Device: device, Timestamp: msg.Timestamp, State: &msg, UnknownFields: unknown}
+
+	default:
+		return Reading{}, fmt.Errorf("%w %q", ErrUnknownTopic, topic)
+	}
+
+	return r, nil
+}
+
+// DecodeCloud decodes a message in the verbose format sent to Glow's own
+// broker, which carries a reading for each meter. If one meter can't be
+// decoded the other's reading is still returned, along with the error. The
+// format has no tariff information, so readings never have a Price, and as
+// its meters are free form sets of clusters unknown fields aren't reported.
+func DecodeCloud(topic string, payload []byte) ([]Reading, error) {
+	var msg CloudMsg
+	if _, _, err := decodeJSON(payload, &msg); err != nil {
+		return nil, err
+	}
+
+	device := topic[strings.LastIndex(topic, "/")+1:]
+
+	var readings []Reading
+	var errs []string
+
+	elec, ok, err := msg.Electricity()
+	if err == nil && ok {
+		var r Reading
+		if r, err = electricityReading(device, elec, false); err == nil {
+			readings = append(readings, r)
+		}
+	}
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("electricity meter: %v", err))
+	}
+
+	gas, ok, err := msg.Gas()
+	if err == nil && ok {
+		var r Reading
+		if r, err = gasReading(device, gas, false); err == nil {
+			readings = append(readings, r)
+		}
+	}
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("gas meter: %v", err))
+	}
+
+	if len(errs) > 0 {
+		return readings, fmt.Errorf("%w: %s", ErrCloudFormat, strings.Join(errs, "; "))
+	}
+	return readings, nil
+}
+
+// DecodeAll decodes a message in either format, telling them apart by their
+// content.
+func DecodeAll(topic string, payload []byte) ([]Reading, error) {
+	if IsCloudMessage(payload) {
+		return DecodeCloud(topic, payload)
+	}
+
+	r, err := Decode(topic, payload)
+	if err != nil {
+		return nil, err
+	}
+	return []Reading{r}, nil
+}
+
+// DeviceID returns the Glow device ID from a topic of the form
+// glow/<DEVICE_ID>/SENSOR/<meter> or glow/<DEVICE_ID>/STATE, or an empty
+// string if the topic doesn't follow that layout.
+func DeviceID(topic string) string {
+	parts := strings.Split(topic, "/")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] == SensorTopic || parts[i] == StateTopic {
+			return parts[i-1]
+		}
+	}
+	return ""
+}
+
+// decodeJSON unmarshals payload into v, first checking it has each of the
+// required fields, given as dot separated paths, with alternatives any one of
+// which will do separated by "|". Numeric fields sent as
+// strings are converted to numbers, and those sent as empty strings treated
+// as missing. The payload's fields are returned so callers can tell a field
+// which is missing from one which is zero, along with the paths of any fields
+// v doesn't have.
+func decodeJSON(payload []byte, v interface{}, required ...string) (map[string]interface{}, []string, error) {
+	// Keep numbers as they were sent, so they aren't rounded on their way
+	// back through json.Marshal.
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+
+	var fields map[string]interface{}
+	if err := dec.Decode(&fields); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrMalformedJSON, err)
+	}
+	coerceNumbers(fields)
+
+	for _, alternatives := range required {
+		if !hasAnyField(fields, strings.Split(alternatives, "|")) {
+			return nil, nil, fmt.Errorf("%w %s", ErrMissingField, strings.ReplaceAll(alternatives, "|", " or "))
+		}
+	}
+
+	coerced, err := json.Marshal(fields)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrMalformedJSON, err)
+	}
+	if err := json.Unmarshal(coerced, v); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrMalformedJSON, err)
+	}
+
+	unknown := unknownFields(fields, reflect.TypeOf(v).Elem(), "")
+	sort.Strings(unknown)
+
+	return fields, unknown, nil
+}
+
+// coerceNumbers converts the numeric fields in fields which were sent as
+// strings to numbers, and deletes those sent as empty strings. Strings which
+// aren't numbers are left for the decode to reject.
+func coerceNumbers(fields map[string]interface{}) {
+	for k, v := range fields {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			coerceNumbers(v)
+		case string:
+			if !numericFields[k] {
+				continue
+			}
+			s := strings.TrimSpace(v)
+			if s == "" {
+				delete(fields, k)
+				continue
+			}
+			if _, err := strconv.ParseFloat(s, 64); err == nil {
+				fields[k] = json.Number(s)
+			}
+		}
+	}
+}
+
+// unknownFields returns the dot separated paths of the fields which the
+// struct type t doesn't have, prefixed by prefix. Maps take any field, so
+// aren't descended into.
+func unknownFields(fields map[string]interface{}, t reflect.Type, prefix string) []string {
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var unknown []string
+	for k, v := range fields {
+		f, ok := jsonField(t, k)
+		if !ok {
+			unknown = append(unknown, prefix+k)
+			continue
+		}
+		if nested, ok := v.(map[string]interface{}); ok {
+			unknown = append(unknown, unknownFields(nested, f.Type, prefix+k+".")...)
+		}
+	}
+	return unknown
+}
+
+// jsonField returns the field of the struct type t which key decodes into,
+// matching names case insensitively as encoding/json does.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = f.Name
+		}
+		if strings.EqualFold(name, key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// hasPrice reports whether the price at path has both a unit rate and a
+// standing charge. Exporting a missing one as zero would look like a real
+// tariff, so a partial price is treated as no price at all.
+func hasPrice(fields map[string]interface{}, path string) bool {
+	return hasField(fields, strings.Split(path+".unitrate", ".")) &&
+		hasField(fields, strings.Split(path+".standingcharge", "."))
+}
+
+// hasAnyField reports whether fields has any of paths, given as dot separated
+// paths.
+func hasAnyField(fields map[string]interface{}, paths []string) bool {
+	for _, path := range paths {
+		if hasField(fields, strings.Split(path, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasField(fields map[string]interface{}, path []string) bool {
+	v, ok := fields[path[0]]
+	if !ok || v == nil {
+		return false
+	}
+	if len(path) == 1 {
+		return true
+	}
+	nested, ok := v.(map[string]interface{})
+	return ok && hasField(nested, path[1:])
+}
@@ -0,0 +1,517 @@
+package brightmqtt
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Payloads as documented in types.go and cloud.go.
+const (
+	electricityPayload = `{
+		"electricitymeter": {
+			"timestamp": "2022-08-25T06:16:59Z",
+			"energy": {
+				"export": {"cumulative": 0, "units": "kWh"},
+				"import": {
+					"cumulative": 4896.645, "day": 0.003, "week": 0.035, "month": 0.257,
+					"units": "kWh", "mpan": "1012400931394", "supplier": "British Gas",
+					"price": {"unitrate": 0.2924, "standingcharge": 0.3792}
+				}
+			},
+			"power": {"value": 0.481, "units": "kW"}
+		}
+	}`
+
+	gasPayload = `{
+		"gasmeter": {
+			"timestamp": "2022-08-25T06:27:51Z",
+			"energy": {
+				"import": {
+					"cumulative": 12491.78, "day": 0, "week": 14.334, "month": 109.153,
+					"units": "kWh", "cumulativevol": 1107.678, "cumulativevolunits": "m3",
+					"dayvol": 0, "weekvol": 14.334, "monthvol": 109.153,
+					"dayweekmonthvolunits": "kWh", "mprn": "3342241002", "supplier": "---",
+					"price": {"unitrate": 0.07344, "standingcharge": 0.2722}
+				}
+			}
+		}
+	}`
+
+	statePayload = `{
+		"software": "v1.8.12",
+		"timestamp": "2022-08-25T06:27:51Z",
+		"hardware": "GLOW-IHD-01-1v4-SMETS2",
+		"ethmac": "1234567890AB",
+		"smetsversion": "SMETS2",
+		"eui": "12:34:56:78:91:23:45:67",
+		"zigbee": "1.2.5",
+		"uptime": 86400,
+		"wifi": {"rssi": -61},
+		"han": {"rssi": -75, "status": "joined", "lqi": 100}
+	}`
+
+	cloudPayload = `{
+		"gid": "1234567890ab",
+		"time": "1661408219",
+		"elecMtr": {
+			"0702": {
+				"00": {"00": "00000049b9a5"},
+				"03": {"00": "00", "01": "000001", "02": "0003e8", "07": "31303132343030393331333934"},
+				"04": {"00": "0001e1", "01": "000003", "30": "000023", "40": "000101"}
+			}
+		},
+		"gasMtr": {
+			"0702": {
+				"00": {"00": "0000000437fe"},
+				"03": {"00": "01", "01": "000001", "02": "0003e8", "07": "33333432323431303032"}
+			}
+		}
+	}`
+
+	// cloudExportingPayload has a negative instantaneous demand, sent as a
+	// 24 bit two's complement value, from a household exporting power.
+	cloudExportingPayload = `{
+		"gid": "1234567890ab",
+		"time": "1661408219",
+		"elecMtr": {
+			"0702": {
+				"00": {"00": "00000049b9a5", "01": "000000000bb8"},
+				"03": {"00": "00", "01": "000001", "02": "0003e8"},
+				"04": {"00": "fffe1f"}
+			}
+		}
+	}`
+)
+
+var (
+	electricityReadingWant = Reading{
+		Kind:      KindElectricity,
+		Device:    "ABCDEF",
+		Timestamp: time.Date(2022, 8, 25, 6, 16, 59, 0, time.UTC),
+		MeterID:   "1012400931394",
+		Supplier:  "British Gas",
+		Power:     0.481,
+		Import:    Usage{Cumulative: 4896.645, Day: 0.003, Week: 0.035, Month: 0.257},
+		Price:     &Price{Unitrate: 0.2924, StandingCharge: 0.3792},
+	}
+
+	gasReadingWant = Reading{
+		Kind:      KindGas,
+		Device:    "ABCDEF",
+		Timestamp: time.Date(2022, 8, 25, 6, 27, 51, 0, time.UTC),
+		MeterID:   "3342241002",
+		Import:    Usage{Cumulative: 12491.78, Day: 0, Week: 14.334, Month: 109.153},
+		Volume:    Usage{Cumulative: 1107.678},
+		Price:     &Price{Unitrate: 0.07344, StandingCharge: 0.2722},
+	}
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		topic   string
+		payload string
+		want    Reading
+		wantErr error
+	}{
+		{
+			name:    "electricity",
+			topic:   "glow/ABCDEF/SENSOR/electricitymeter",
+			payload: electricityPayload,
+			want:    electricityReadingWant,
+		},
+		{
+			name:    "gas",
+			topic:   "glow/ABCDEF/SENSOR/gasmeter",
+			payload: gasPayload,
+			want:    gasReadingWant,
+		},
+		{
+			name:    "state",
+			topic:   "glow/ABCDEF/STATE",
+			payload: statePayload,
+			want: Reading{
+				Kind:      KindState,
+				Device:    "ABCDEF",
+				Timestamp: time.Date(2022, 8, 25, 6, 27, 51, 0, time.UTC),
+				State: &StateMsg{
+					Software:     "v1.8.12",
+					Timestamp:    time.Date(2022, 8, 25, 6, 27, 51, 0, time.UTC),
+					Hardware:     "GLOW-IHD-01-1v4-SMETS2",
+					Ethmac:       "1234567890AB",
+					Smetsversion: "SMETS2",
+					Eui:          "12:34:56:78:91:23:45:67",
+					Zigbee:       "1.2.5",
+					Uptime:       86400,
+					Wifi:         Wifi{Rssi: -61},
+					Han:          Han{Rssi: -75, Status: "joined", Lqi: 100},
+				},
+			},
+		},
+		{
+			name:    "unknown topic",
+			topic:   "glow/ABCDEF/SENSOR/watermeter",
+			payload: `{}`,
+			wantErr: ErrUnknownTopic,
+		},
+		{
+			name:    "invalid JSON",
+			topic:   "glow/ABCDEF/SENSOR/electricitymeter",
+			payload: `{"electricitymeter": {`,
+			wantErr: ErrMalformedJSON,
+		},
+		{
+			name:    "wrong shape",
+			topic:   "glow/ABCDEF/SENSOR/electricitymeter",
+			payload: `{"electricitymeter": {"energy": {"import": {"cumulative": 1, "mpan": 1012400931394}}}}`,
+			wantErr: ErrMalformedJSON,
+		},
+		{
+			name:    "missing cumulative",
+			topic:   "glow/ABCDEF/SENSOR/electricitymeter",
+			payload: `{"electricitymeter": {"energy": {"import": {"day": 0.003, "units": "kWh"}}}}`,
+			wantErr: ErrMissingField,
+		},
+		{
+			name:    "gas volume only",
+			topic:   "glow/ABCDEF/SENSOR/gasmeter",
+			payload: `{"gasmeter":{"energy":{"import":{"cumulativevol":1107.6,"cumulativevolunits":"m3"}}}}`,
+			want: Reading{
+				Kind:   KindGas,
+				Device: "ABCDEF",
+				Volume: Usage{Cumulative: 1107.6},
+			},
+		},
+		{
+			name:    "missing gas meter",
+			topic:   "glow/ABCDEF/SENSOR/gasmeter",
+			payload: `{}`,
+			wantErr: ErrMissingField,
+		},
+		{
+			name:    "unknown unit",
+			topic:   "glow/ABCDEF/SENSOR/electricitymeter",
+			payload: `{"electricitymeter": {"energy": {"import": {"cumulative": 1, "units": "therms"}}}}`,
+			wantErr: ErrUnknownUnit,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode(tt.topic, []byte(tt.payload))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCloud(t *testing.T) {
+	ts := time.Date(2022, 8, 25, 6, 16, 59, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		payload string
+		want    []Reading
+		wantErr error
+	}{
+		{
+			name:    "both meters",
+			payload: cloudPayload,
+			want: []Reading{
+				{
+					Kind:      KindElectricity,
+					Device:    "1234567890ab",
+					Timestamp: ts,
+					MeterID:   "1012400931394",
+					Power:     0.481,
+					Import:    Usage{Cumulative: 4831.653, Day: 0.003, Week: 0.035, Month: 0.257},
+				},
+				{
+					Kind:          KindGas,
+					Device:        "1234567890ab",
+					Timestamp:     ts,
+					MeterID:       "3342241002",
+					Volume:        Usage{Cumulative: 276.478},
+					VolumePeriods: true,
+				},
+			},
+		},
+		{
+			name:    "signed demand",
+			payload: cloudExportingPayload,
+			want: []Reading{
+				{
+					Kind:      KindElectricity,
+					Device:    "1234567890ab",
+					Timestamp: ts,
+					Power:     -0.481,
+					Import:    Usage{Cumulative: 4831.653},
+					Export:    Usage{Cumulative: 3},
+				},
+			},
+		},
+		{
+			name:    "invalid JSON",
+			payload: `{"elecMtr": `,
+			wantErr: ErrMalformedJSON,
+		},
+		{
+			name:    "bad attribute",
+			payload: `{"time": "1661408219", "elecMtr": {"0702": {"00": {"00": "zz"}}}}`,
+			wantErr: ErrCloudFormat,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeCloud("SMART/HILD/1234567890ab", []byte(tt.payload))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCloudPartial(t *testing.T) {
+	payload := `{
+		"time": "1661408219",
+		"elecMtr": {"0702": {"00": {"00": "zz"}}},
+		"gasMtr": {"0702": {"00": {"00": "0000000437fe"}, "03": {"00": "01", "02": "0003e8"}}}
+	}`
+
+	got, err := DecodeCloud("SMART/HILD/1234567890ab", []byte(payload))
+	if !errors.Is(err, ErrCloudFormat) {
+		t.Errorf("error = %v, want ErrCloudFormat", err)
+	}
+	if len(got) != 1 || got[0].Kind != KindGas {
+		t.Errorf("got %+v, want the gas reading", got)
+	}
+}
+
+func TestDecodeAll(t *testing.T) {
+	tests := []struct {
+		name    string
+		topic   string
+		payload string
+		kinds   []Kind
+		wantErr error
+	}{
+		{"local", "glow/ABCDEF/SENSOR/electricitymeter", electricityPayload, []Kind{KindElectricity}, nil},
+		{"cloud", "SMART/HILD/1234567890ab", cloudPayload, []Kind{KindElectricity, KindGas}, nil},
+		{"unknown topic", "glow/ABCDEF/SENSOR/watermeter", `{}`, nil, ErrUnknownTopic},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeAll(tt.topic, []byte(tt.payload))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			var kinds []Kind
+			for _, r := range got {
+				kinds = append(kinds, r.Kind)
+			}
+			if !reflect.DeepEqual(kinds, tt.kinds) {
+				t.Errorf("kinds = %v, want %v", kinds, tt.kinds)
+			}
+		})
+	}
+}
+
+func TestDeviceID(t *testing.T) {
+	for topic, want := range map[string]string{
+		"glow/ABCDEF/SENSOR/electricitymeter": "ABCDEF",
+		"home/glow/ABCDEF/STATE":              "ABCDEF",
+		"glow/ABCDEF":                         "",
+	} {
+		if got := DeviceID(topic); got != want {
+			t.Errorf("DeviceID(%q) = %q, want %q", topic, got, want)
+		}
+	}
+}
+
+func TestDecodeLenient(t *testing.T) {
+	const topic = "glow/ABCDEF/SENSOR/electricitymeter"
+
+	tests := []struct {
+		name    string
+		payload string
+		check   func(t *testing.T, r Reading)
+		wantErr error
+	}{
+		{
+			name: "numeric strings",
+			payload: `{"electricitymeter": {"energy": {"import": {"cumulative": "4896.645", "day": " 0.003 ",
+				"units": "kWh", "mpan": "1012400931394", "price": {"unitrate": "0.2924", "standingcharge": "0.3792"}}},
+				"power": {"value": "-0.481", "units": "kW"}}}`,
+			check: func(t *testing.T, r Reading) {
+				if r.Import.Cumulative != 4896.645 || r.Import.Day != 0.003 || r.Power != -0.481 {
+					t.Errorf("got import %+v and power %v", r.Import, r.Power)
+				}
+				if r.Price == nil || *r.Price != (Price{Unitrate: 0.2924, StandingCharge: 0.3792}) {
+					t.Errorf("price = %+v", r.Price)
+				}
+				if r.MeterID != "1012400931394" {
+					t.Errorf("MeterID = %q, want it left a string", r.MeterID)
+				}
+			},
+		},
+		{
+			name:    "empty strings are missing",
+			payload: `{"electricitymeter": {"energy": {"import": {"cumulative": 1, "day": "", "units": "kWh"}}}}`,
+			check: func(t *testing.T, r Reading) {
+				if r.Import.Day != 0 {
+					t.Errorf("day = %v, want 0", r.Import.Day)
+				}
+			},
+		},
+		{
+			name:    "empty cumulative",
+			payload: `{"electricitymeter": {"energy": {"import": {"cumulative": "", "units": "kWh"}}}}`,
+			wantErr: ErrMissingField,
+		},
+		{
+			name:    "non-numeric string",
+			payload: `{"electricitymeter": {"energy": {"import": {"cumulative": "n/a", "units": "kWh"}}}}`,
+			wantErr: ErrMalformedJSON,
+		},
+		{
+			name:    "missing price",
+			payload: `{"electricitymeter": {"energy": {"import": {"cumulative": 1, "units": "kWh"}}}}`,
+			check: func(t *testing.T, r Reading) {
+				if r.Price != nil {
+					t.Errorf("price = %+v, want nil", *r.Price)
+				}
+			},
+		},
+		{
+			name:    "null price",
+			payload: `{"electricitymeter": {"energy": {"import": {"cumulative": 1, "price": null}}}}`,
+			check: func(t *testing.T, r Reading) {
+				if r.Price != nil {
+					t.Errorf("price = %+v, want nil", *r.Price)
+				}
+			},
+		},
+		{
+			name:    "partial price",
+			payload: `{"electricitymeter": {"energy": {"import": {"cumulative": 1, "price": {"unitrate": 0.2924, "standingcharge": ""}}}}}`,
+			check: func(t *testing.T, r Reading) {
+				if r.Price != nil {
+					t.Errorf("price = %+v, want nil", *r.Price)
+				}
+			},
+		},
+		{
+			name:    "zero price",
+			payload: `{"electricitymeter": {"energy": {"import": {"cumulative": 1, "price": {"unitrate": 0, "standingcharge": 0}}}}}`,
+			check: func(t *testing.T, r Reading) {
+				if r.Price == nil || *r.Price != (Price{}) {
+					t.Errorf("price = %+v, want zero", r.Price)
+				}
+			},
+		},
+		{
+			name:    "unknown supplier",
+			payload: `{"electricitymeter": {"energy": {"import": {"cumulative": 1, "supplier": "---"}}}}`,
+			check: func(t *testing.T, r Reading) {
+				if r.Supplier != "" {
+					t.Errorf("supplier = %q, want empty", r.Supplier)
+				}
+			},
+		},
+		{
+			name: "unknown fields",
+			payload: `{"electricitymeter": {"energy": {"import": {"cumulative": 1, "tariff": "E7"}},
+				"power": {"value": 0.481, "peak": 3}}, "firmware": "v2"}`,
+			check: func(t *testing.T, r Reading) {
+				want := []string{"electricitymeter.energy.import.tariff", "electricitymeter.power.peak", "firmware"}
+				if !reflect.DeepEqual(r.UnknownFields, want) {
+					t.Errorf("UnknownFields = %q, want %q", r.UnknownFields, want)
+				}
+			},
+		},
+		{
+			name:    "negative cumulative",
+			payload: `{"electricitymeter": {"energy": {"import": {"cumulative": -4896.645, "units": "kWh"}}}}`,
+			wantErr: ErrOutOfRange,
+		},
+		{
+			name:    "negative export",
+			payload: `{"electricitymeter": {"energy": {"import": {"cumulative": 1}, "export": {"cumulative": "-1"}}}}`,
+			wantErr: ErrOutOfRange,
+		},
+		{
+			name:    "negative standing charge",
+			payload: `{"electricitymeter": {"energy": {"import": {"cumulative": 1, "price": {"unitrate": 0.2, "standingcharge": -0.3}}}}}`,
+			wantErr: ErrOutOfRange,
+		},
+		{
+			name:    "negative unit rate",
+			payload: `{"electricitymeter": {"energy": {"import": {"cumulative": 1, "price": {"unitrate": -0.02, "standingcharge": 0.3}}}}}`,
+			check: func(t *testing.T, r Reading) {
+				if r.Price == nil || r.Price.Unitrate != -0.02 {
+					t.Errorf("price = %+v, want a unit rate of -0.02", r.Price)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode(topic, []byte(tt.payload))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, got)
+		})
+	}
+}
+
+func TestDecodeLenientGas(t *testing.T) {
+	payload := `{"gasmeter": {"energy": {"import": {"cumulative": "12491.78", "cumulativevol": "1107.678",
+		"cumulativevolunits": "m3", "supplier": "---"}}}}`
+
+	r, err := Decode("glow/ABCDEF/SENSOR/gasmeter", []byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Import.Cumulative != 12491.78 || r.Volume.Cumulative != 1107.678 {
+		t.Errorf("got import %+v and volume %+v", r.Import, r.Volume)
+	}
+	if r.Price != nil || r.Supplier != "" || r.VolumePeriods {
+		t.Errorf("got price %+v, supplier %q and VolumePeriods %v, want none", r.Price, r.Supplier, r.VolumePeriods)
+	}
+
+	payload = `{"gasmeter": {"energy": {"import": {"cumulative": 1, "cumulativevol": -1}}}}`
+	if _, err := Decode("glow/ABCDEF/SENSOR/gasmeter", []byte(payload)); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("negative volume error = %v, want ErrOutOfRange", err)
+	}
+}
@@ -0,0 +1,16 @@
+package brightmqtt
+
+// StandardCorrectionFactor is the UK volume correction factor, which adjusts
+// a metered gas volume for the standard temperature and pressure it is billed
+// at.
+const StandardCorrectionFactor = 1.02264
+
+// megajoulesPerKilowattHour converts the calorific value, in MJ/m3, to kWh.
+const megajoulesPerKilowattHour = 3.6
+
+// VolumeToEnergy converts a gas volume in m3 to energy in kWh using the
+// standard UK formula, volume × correction factor × calorific value / 3.6,
+// where the calorific value is in MJ/m3 and is shown on gas bills.
+func VolumeToEnergy(volume, calorificValue, correctionFactor float64) float64 {
+	return volume * correctionFactor * calorificValue / megajoulesPerKilowattHour
+}
@@ -0,0 +1,173 @@
+package brightmqtt
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// noSupplier is sent as the supplier by firmware which doesn't know it.
+const noSupplier = "---"
+
+// Kind is the kind of message a Reading was decoded from.
+type Kind string
+
+const (
+	KindElectricity Kind = "electricity"
+	KindGas         Kind = "gas"
+	KindState       Kind = "state"
+)
+
+// Usage is a cumulative meter reading along with the amount used so far in
+// the current day, week and month.
+type Usage struct {
+	Cumulative float64
+	Day        float64
+	Week       float64
+	Month      float64
+}
+
+// Reading is a single meter reading, or the state of a dongle, decoded from a
+// message in either format. Every quantity is normalised, power to kW, energy
+// to kWh and volume to m3.
+type Reading struct {
+	Kind Kind
+
+	// Device is the ID of the Glow dongle which sent the message.
+	Device string
+
+	// Timestamp is when the meter was read, or the zero time if the message
+	// didn't say.
+	Timestamp time.Time
+
+	// MeterID is the MPAN of an electricity meter or MPRN of a gas meter,
+	// and Supplier the energy supplier, if the firmware reports them.
+	MeterID  string
+	Supplier string
+
+	// Power is the instantaneous demand of an electricity meter.
+	Power float64
+
+	// Import is the energy imported and Export, for electricity meters,
+	// the energy exported e.g. from solar or a battery.
+	Import Usage
+	Export Usage
+
+	// Volume is the gas volume used, for gas meters. Most firmware sends
+	// the day, week and month volumes in kWh, so they are only set when
+	// VolumePeriods is true.
+	Volume        Usage
+	VolumePeriods bool
+
+	// Price is the tariff in force, or nil if the message didn't include
+	// one.
+	Price *Price
+
+	// State is the state of the dongle, for KindState readings only.
+	State *StateMsg
+
+	// UnknownFields are the dot separated paths of any fields in the
+	// message the decoder doesn't know, e.g. ones added by newer firmware.
+	UnknownFields []string
+}
+
+// electricityReading returns the reading from m, with its price only if
+// priced is true.
+func electricityReading(device string, m ElectricityMeter, priced bool) (Reading, error) {
+	m, err := m.Normalised()
+	if err != nil {
+		return Reading{}, err
+	}
+
+	imp, exp := m.Energy.Import, m.Energy.Export
+	r := Reading{
+		Kind:      KindElectricity,
+		Device:    device,
+		Timestamp: m.Timestamp,
+		MeterID:   imp.Mpan,
+		Supplier:  supplier(imp.Supplier),
+		Power:     m.Power.Value,
+		Import:    Usage{Cumulative: imp.Cumulative, Day: imp.Day, Week: imp.Week, Month: imp.Month},
+		Export:    Usage{Cumulative: exp.Cumulative, Day: exp.Day, Week: exp.Week, Month: exp.Month},
+	}
+	if priced {
+		r.Price = &imp.Price
+	}
+
+	return r, r.validate()
+}
+
+// gasReading returns the reading from m, with its price only if priced is
+// true.
+func gasReading(device string, m GasMeter, priced bool) (Reading, error) {
+	m, err := m.Normalised()
+	if err != nil {
+		return Reading{}, err
+	}
+
+	imp := m.Energy.Import
+	r := Reading{
+		Kind:      KindGas,
+		Device:    device,
+		Timestamp: m.Timestamp,
+		MeterID:   imp.Mprn,
+		Supplier:  supplier(imp.Supplier),
+		Import:    Usage{Cumulative: imp.Cumulative, Day: imp.Day, Week: imp.Week, Month: imp.Month},
+		Volume:    Usage{Cumulative: imp.Cumulativevol},
+	}
+	if priced {
+		r.Price = &imp.Price
+	}
+
+	if imp.Dayweekmonthvolunits == CubicMetres {
+		r.Volume.Day, r.Volume.Week, r.Volume.Month = imp.Dayvol, imp.Weekvol, imp.Monthvol
+		r.VolumePeriods = true
+	}
+
+	return r, r.validate()
+}
+
+// validate checks every quantity which can't go below zero hasn't, so a
+// corrupt reading is rejected rather than stored. Power goes negative while
+// exporting and unit rates do on some dynamic tariffs, so neither is checked.
+func (r Reading) validate() error {
+	if err := r.Import.validate("import"); err != nil {
+		return err
+	}
+	if err := r.Export.validate("export"); err != nil {
+		return err
+	}
+	if err := r.Volume.validate("volume"); err != nil {
+		return err
+	}
+	if r.Price != nil && r.Price.StandingCharge < 0 {
+		return fmt.Errorf("%w: standing charge %v", ErrOutOfRange, r.Price.StandingCharge)
+	}
+	return nil
+}
+
+func (u Usage) validate(name string) error {
+	for _, v := range []struct {
+		period string
+		value  float64
+	}{
+		{"cumulative", u.Cumulative},
+		{"day", u.Day},
+		{"week", u.Week},
+		{"month", u.Month},
+	} {
+		if v.value < 0 {
+			return fmt.Errorf("%w: %s %s %v", ErrOutOfRange, name, v.period, v.value)
+		}
+	}
+	return nil
+}
+
+// supplier returns s, or an empty string if the firmware didn't know the
+// supplier.
+func supplier(s string) string {
+	if strings.TrimSpace(s) == noSupplier {
+		return ""
+	}
+	return s
+}
@@ -1,9 +1,9 @@
 package brightmqtt
 
 // This file defines the Go structs for parsing an MQTT message received from
-// the Glow ethernet dongle. This is for messages sent to /your/ MQTT broker
-// it will not work for messages sent to Glow's own broker, they are in the
-// more verbose format.
+// the Glow ethernet dongle. This is for messages sent to /your/ MQTT broker,
+// messages sent to Glow's own broker are in the more verbose format decoded
+// in cloud.go.
 //
 // Example electricity meter message:
 //
@@ -65,6 +65,28 @@ package brightmqtt
 //     }
 // }
 //
+// Example state message, sent on the STATE topic rather than SENSOR. uptime
+// and wifi are only sent by some firmware versions:
+//
+// {
+//     "software": "v1.8.12",
+//     "timestamp": "2022-08-25T06:27:51Z",
+//     "hardware": "GLOW-IHD-01-1v4-SMETS2",
+//     "ethmac": "1234567890AB",
+//     "smetsversion": "SMETS2",
+//     "eui": "12:34:56:78:91:23:45:67",
+//     "zigbee": "1.2.5",
+//     "uptime": 86400,
+//     "wifi": {
+//         "rssi": -61
+//     },
+//     "han": {
+//         "rssi": -75,
+//         "status": "joined",
+//         "lqi": 100
+//     }
+// }
+//
 import (
 	"time"
 )
@@ -125,9 +147,15 @@ type ElectricityImport struct {
 	Week       float64 `json:"week"`
 }
 
+// ElectricityExport is only non-zero for households generating their own
+// power, e.g. from solar or a battery. Day, Week and Month are only sent by
+// some firmware versions.
 type ElectricityExport struct {
-	Cummulative float64 `json:"cummulative"`
-	Units       string  `json:"units"`
+	Cumulative float64 `json:"cumulative"`
+	Day        float64 `json:"day"`
+	Week       float64 `json:"week"`
+	Month      float64 `json:"month"`
+	Units      string  `json:"units"`
 }
 
 type Power struct {
@@ -139,3 +167,29 @@ type Price struct {
 	StandingCharge float64 `json:"standingcharge"`
 	Unitrate       float64 `json:"unitrate"`
 }
+
+type StateMsg struct {
+	Software     string    `json:"software"`
+	Timestamp    time.Time `json:"timestamp"`
+	Hardware     string    `json:"hardware"`
+	Ethmac       string    `json:"ethmac"`
+	Wifistamac   string    `json:"wifistamac"`
+	Smetsversion string    `json:"smetsversion"`
+	Eui          string    `json:"eui"`
+	Zigbee       string    `json:"zigbee"`
+	Uptime       float64   `json:"uptime"`
+	Wifi         Wifi      `json:"wifi"`
+	Han          Han       `json:"han"`
+}
+
+type Wifi struct {
+	Rssi float64 `json:"rssi"`
+}
+
+// Han is the state of the dongle's link to the smart meter's home area
+// network.
+type Han struct {
+	Rssi   float64 `json:"rssi"`
+	Status string  `json:"status"`
+	Lqi    float64 `json:"lqi"`
+}
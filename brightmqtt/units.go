@@ -0,0 +1,126 @@
+package brightmqtt
+
+// This file normalises the units reported by the dongle. Depending on the
+// firmware power may be reported in W or kW, energy in Wh or kWh and gas
+// volume in m3 or ft3, so every reading is converted to the canonical unit of
+// its quantity before use.
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Canonical units every reading is normalised to.
+const (
+	Kilowatts     = "kW"
+	KilowattHours = "kWh"
+	CubicMetres   = "m3"
+)
+
+// ErrUnknownUnit is returned when a reading is in a unit which isn't in the
+// conversion table, or isn't a unit of the expected quantity.
+var ErrUnknownUnit = errors.New("unknown unit")
+
+type conversion struct {
+	canonical string
+	factor    float64
+}
+
+// conversions maps each supported unit, in lower case, to its canonical unit
+// and the factor to multiply by to convert to it. Units are matched case
+// insensitively as firmware is inconsistent about case, so there are no
+// megawatt entries, which would also match milliwatts.
+var conversions = map[string]conversion{
+	"w":   {Kilowatts, 0.001},
+	"kw":  {Kilowatts, 1},
+	"wh":  {KilowattHours, 0.001},
+	"kwh": {KilowattHours, 1},
+	"m3":  {CubicMetres, 1},
+	"dm3": {CubicMetres, 0.001},
+	"ft3": {CubicMetres, 0.028316846592},
+	"ccf": {CubicMetres, 2.8316846592}, // hundreds of cubic feet
+}
+
+// Normalise converts value from unit to the canonical unit for its quantity,
+// returning the converted value and the canonical unit.
+func Normalise(value float64, unit string) (float64, string, error) {
+	c, ok := conversions[strings.ToLower(unit)]
+	if !ok {
+		return value, unit, fmt.Errorf("%w %q", ErrUnknownUnit, unit)
+	}
+	return value * c.factor, c.canonical, nil
+}
+
+// normaliseAll converts every value in place from unit to canonical. Readings
+// without a unit are assumed to already be canonical.
+func normaliseAll(unit, canonical string, values ...*float64) (string, error) {
+	if unit == "" {
+		return canonical, nil
+	}
+
+	c, ok := conversions[strings.ToLower(unit)]
+	if !ok {
+		return unit, fmt.Errorf("%w %q", ErrUnknownUnit, unit)
+	}
+	if c.canonical != canonical {
+		return unit, fmt.Errorf("%w %q, expected a unit convertible to %s", ErrUnknownUnit, unit, canonical)
+	}
+
+	for _, v := range values {
+		*v *= c.factor
+	}
+	return canonical, nil
+}
+
+// Normalised returns m with power in kW and energy in kWh.
+func (m ElectricityMeter) Normalised() (ElectricityMeter, error) {
+	var err error
+
+	if m.Power.Units, err = normaliseAll(m.Power.Units, Kilowatts, &m.Power.Value); err != nil {
+		return m, fmt.Errorf("power: %w", err)
+	}
+
+	imp := &m.Energy.Import
+	if imp.Units, err = normaliseAll(imp.Units, KilowattHours, &imp.Cumulative, &imp.Day, &imp.Week, &imp.Month); err != nil {
+		return m, fmt.Errorf("import: %w", err)
+	}
+
+	exp := &m.Energy.Export
+	if exp.Units, err = normaliseAll(exp.Units, KilowattHours, &exp.Cumulative, &exp.Day, &exp.Week, &exp.Month); err != nil {
+		return m, fmt.Errorf("export: %w", err)
+	}
+
+	return m, nil
+}
+
+// Normalised returns m with energy in kWh and volume in m3. The day, week and
+// month "volumes" are reported in kWh by most firmware, in which case they are
+// left in kWh, and without a unit there's no telling which they are, so they
+// are left as they are.
+func (m GasMeter) Normalised() (GasMeter, error) {
+	var err error
+
+	imp := &m.Energy.Import
+	if imp.Units, err = normaliseAll(imp.Units, KilowattHours, &imp.Cumulative, &imp.Day, &imp.Week, &imp.Month); err != nil {
+		return m, fmt.Errorf("import: %w", err)
+	}
+
+	if imp.Cumulativevolunits, err = normaliseAll(imp.Cumulativevolunits, CubicMetres, &imp.Cumulativevol); err != nil {
+		return m, fmt.Errorf("volume: %w", err)
+	}
+
+	if imp.Dayweekmonthvolunits == "" {
+		return m, nil
+	}
+
+	canonical := CubicMetres
+	if c, ok := conversions[strings.ToLower(imp.Dayweekmonthvolunits)]; ok && c.canonical == KilowattHours {
+		canonical = c.canonical
+	}
+	if imp.Dayweekmonthvolunits, err = normaliseAll(imp.Dayweekmonthvolunits, canonical, &imp.Dayvol, &imp.Weekvol, &imp.Monthvol); err != nil {
+		return m, fmt.Errorf("day, week and month volume: %w", err)
+	}
+
+	return m, nil
+}
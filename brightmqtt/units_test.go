@@ -0,0 +1,172 @@
+package brightmqtt
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestNormalise(t *testing.T) {
+	tests := []struct {
+		unit      string
+		value     float64
+		want      float64
+		canonical string
+	}{
+		{"W", 481, 0.481, Kilowatts},
+		{"kW", 0.481, 0.481, Kilowatts},
+		{"KW", 0.481, 0.481, Kilowatts},
+		{"Wh", 4896645, 4896.645, KilowattHours},
+		{"kWh", 4896.645, 4896.645, KilowattHours},
+		{"KWH", 4896.645, 4896.645, KilowattHours},
+		{"m3", 1107.678, 1107.678, CubicMetres},
+		{"dm3", 1107678, 1107.678, CubicMetres},
+		{"ft3", 1000, 28.316846592, CubicMetres},
+		{"ccf", 10, 28.316846592, CubicMetres},
+	}
+
+	// Every entry in the conversion table must be covered.
+	covered := make(map[string]bool)
+	for _, tt := range tests {
+		covered[strings.ToLower(tt.unit)] = true
+	}
+	for unit := range conversions {
+		if !covered[unit] {
+			t.Errorf("no test for unit %q", unit)
+		}
+	}
+
+	for _, tt := range tests {
+		got, canonical, err := Normalise(tt.value, tt.unit)
+		if err != nil {
+			t.Errorf("Normalise(%v, %q) error: %v", tt.value, tt.unit, err)
+			continue
+		}
+		if math.Abs(got-tt.want) > 1e-9 || canonical != tt.canonical {
+			t.Errorf("Normalise(%v, %q) = %v %s, want %v %s", tt.value, tt.unit, got, canonical, tt.want, tt.canonical)
+		}
+	}
+}
+
+func TestNormaliseUnknownUnit(t *testing.T) {
+	// mW would be milliwatts, which mustn't be mistaken for megawatts.
+	for _, unit := range []string{"mW", "MW", "MWh", "therms", ""} {
+		if _, _, err := Normalise(1, unit); !errors.Is(err, ErrUnknownUnit) {
+			t.Errorf("Normalise(1, %q) error = %v, want ErrUnknownUnit", unit, err)
+		}
+	}
+}
+
+func TestNormaliseAll(t *testing.T) {
+	t.Run("converts every value", func(t *testing.T) {
+		a, b := 1000.0, 2500.0
+		unit, err := normaliseAll("Wh", KilowattHours, &a, &b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unit != KilowattHours || a != 1 || b != 2.5 {
+			t.Errorf("got %v, %v %s, want 1, 2.5 kWh", a, b, unit)
+		}
+	})
+
+	t.Run("missing unit is canonical", func(t *testing.T) {
+		v := 3.0
+		unit, err := normaliseAll("", Kilowatts, &v)
+		if err != nil || unit != Kilowatts || v != 3 {
+			t.Errorf("got %v %s, %v, want 3 kW", v, unit, err)
+		}
+	})
+
+	t.Run("wrong quantity", func(t *testing.T) {
+		v := 3.0
+		if _, err := normaliseAll("kWh", Kilowatts, &v); !errors.Is(err, ErrUnknownUnit) {
+			t.Errorf("error = %v, want ErrUnknownUnit", err)
+		}
+		if v != 3 {
+			t.Errorf("value changed to %v", v)
+		}
+	})
+}
+
+func TestElectricityMeterNormalised(t *testing.T) {
+	var m ElectricityMeter
+	m.Power = Power{Value: 481, Units: "W"}
+	m.Energy.Import = ElectricityImport{Cumulative: 4896645, Day: 3, Units: "Wh"}
+	m.Energy.Export = ElectricityExport{Cumulative: 1, Units: "kWh"}
+
+	got, err := m.Normalised()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Power.Value != 0.481 || got.Power.Units != Kilowatts {
+		t.Errorf("power = %v %s, want 0.481 kW", got.Power.Value, got.Power.Units)
+	}
+	if got.Energy.Import.Cumulative != 4896.645 || got.Energy.Import.Day != 0.003 {
+		t.Errorf("import = %+v, want 4896.645 kWh cumulative and 0.003 kWh day", got.Energy.Import)
+	}
+
+	m.Energy.Export.Units = "m3"
+	if _, err := m.Normalised(); !errors.Is(err, ErrUnknownUnit) {
+		t.Errorf("export in m3 error = %v, want ErrUnknownUnit", err)
+	}
+}
+
+func TestGasMeterNormalised(t *testing.T) {
+	tests := []struct {
+		name      string
+		units     string
+		wantUnits string
+		wantDay   float64
+	}{
+		{"periods in kWh", "kWh", KilowattHours, 14},
+		{"periods in Wh", "Wh", KilowattHours, 0.014},
+		{"periods in m3", "m3", CubicMetres, 14},
+		{"periods in ft3", "ft3", CubicMetres, 14 * 0.028316846592},
+		// Without a unit the periods could be either, so are left alone.
+		{"periods without a unit", "", "", 14},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m GasMeter
+			m.Energy.Import = GasImport{
+				Cumulative:           12491.78,
+				Units:                "kWh",
+				Cumulativevol:        1000,
+				Cumulativevolunits:   "ft3",
+				Dayvol:               14,
+				Dayweekmonthvolunits: tt.units,
+			}
+
+			got, err := m.Normalised()
+			if err != nil {
+				t.Fatal(err)
+			}
+			imp := got.Energy.Import
+			if math.Abs(imp.Cumulativevol-28.316846592) > 1e-9 || imp.Cumulativevolunits != CubicMetres {
+				t.Errorf("volume = %v %s, want 28.316846592 m3", imp.Cumulativevol, imp.Cumulativevolunits)
+			}
+			if math.Abs(imp.Dayvol-tt.wantDay) > 1e-9 || imp.Dayweekmonthvolunits != tt.wantUnits {
+				t.Errorf("day volume = %v %q, want %v %q", imp.Dayvol, imp.Dayweekmonthvolunits, tt.wantDay, tt.wantUnits)
+			}
+		})
+	}
+}
+
+// TestGasReadingVolumePeriods checks the day, week and month amounts are only
+// taken as volumes when the message says they are.
+func TestGasReadingVolumePeriods(t *testing.T) {
+	for units, want := range map[string]bool{"m3": true, "ft3": true, "kWh": false, "": false} {
+		var m GasMeter
+		m.Energy.Import = GasImport{Cumulative: 1, Dayvol: 14, Dayweekmonthvolunits: units}
+
+		r, err := gasReading("device", m, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.VolumePeriods != want {
+			t.Errorf("VolumePeriods with %q = %v, want %v", units, r.VolumePeriods, want)
+		}
+	}
+}
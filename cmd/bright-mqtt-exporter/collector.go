@@ -0,0 +1,162 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	bright "github.com/rk295/bright-mqtt-exporter/brightmqtt"
+)
+
+// Describe sends every descriptor Collect can emit, so the registry can check
+// the collector is consistent.
+func (d Data) Describe(ch chan<- *prometheus.Desc) {
+	d.metrics.describe(ch)
+}
+
+func (d Data) Collect(ch chan<- prometheus.Metric) {
+	snap := d.readings.snapshot()
+	now := time.Now()
+
+	for k, r := range snap.electricity {
+		if !d.collectFreshness(ch, k, electricityMetricName, r.Timestamp, now) {
+			continue
+		}
+
+		d.metrics.send(ch, meterInfoMetric, prometheus.GaugeValue, 1,
+			k.device, electricityMetricName, k.id, r.MeterID, "", r.Supplier)
+		d.metrics.send(ch, electricityPowerMetric, prometheus.GaugeValue, r.Power, k.device, k.id)
+
+		d.collectEnergy(ch, energyImportTotalMetric, energyImportMetric, k, electricityMetricName, r.Import)
+		d.collectEnergy(ch, energyExportTotalMetric, energyExportMetric, k, electricityMetricName, r.Export)
+		d.collectPrice(ch, k, electricityMetricName, r.Price)
+		d.collectCost(ch, k, electricityMetricName, snap.electricityCost[k])
+
+		d.metrics.send(ch, energyNetImportMetric, prometheus.GaugeValue,
+			r.Import.Cumulative-r.Export.Cumulative,
+			k.device, electricityMetricName, k.id)
+	}
+
+	for k, r := range snap.gas {
+		if !d.collectFreshness(ch, k, gasMetricName, r.Timestamp, now) {
+			continue
+		}
+
+		d.metrics.send(ch, meterInfoMetric, prometheus.GaugeValue, 1,
+			k.device, gasMetricName, k.id, "", r.MeterID, r.Supplier)
+		d.metrics.send(ch, gasUsageMetric, prometheus.CounterValue, r.Import.Cumulative, k.device, k.id)
+
+		d.collectEnergy(ch, energyImportTotalMetric, energyImportMetric, k, gasMetricName, r.Import)
+		d.collectPrice(ch, k, gasMetricName, r.Price)
+		d.collectCost(ch, k, gasMetricName, snap.gasCost[k])
+
+		d.metrics.send(ch, gasVolumeTotalMetric, prometheus.CounterValue, r.Volume.Cumulative, k.device, k.id)
+
+		// Most firmware sends the day, week and month "volumes" in kWh, in
+		// which case they only repeat the energy readings.
+		if r.VolumePeriods {
+			for period, v := range periods(r.Volume) {
+				d.metrics.send(ch, gasVolumeMetric, prometheus.GaugeValue, v, k.device, k.id, period)
+			}
+		}
+
+		if d.gas.CalorificValue > 0 {
+			d.collectGasEnergy(ch, k, r)
+		}
+	}
+
+	for device, m := range snap.states {
+		d.collectState(ch, device, m)
+	}
+}
+
+// collectState sends the health of a single Glow dongle.
+func (d Data) collectState(ch chan<- prometheus.Metric, device string, m bright.StateMsg) {
+	d.metrics.send(ch, dongleInfoMetric, prometheus.GaugeValue, 1, device, m.Software, m.Hardware, m.Zigbee, m.Smetsversion)
+	d.metrics.send(ch, dongleRssiMetric, prometheus.GaugeValue, m.Han.Rssi, device, "han")
+	d.metrics.send(ch, hanStatusMetric, prometheus.GaugeValue, 1, device, m.Han.Status)
+
+	// Only some firmware reports these, so don't export zeros for the rest.
+	if m.Wifi.Rssi != 0 {
+		d.metrics.send(ch, dongleRssiMetric, prometheus.GaugeValue, m.Wifi.Rssi, device, "wifi")
+	}
+
+	if m.Uptime != 0 {
+		d.metrics.send(ch, dongleUptimeMetric, prometheus.GaugeValue, m.Uptime, device)
+	}
+}
+
+// collectFreshness sends the last reading time and up status for a single
+// meter, returning false if the reading is older than the configured max age
+// and the rest of the meter's series should be skipped.
+func (d Data) collectFreshness(ch chan<- prometheus.Metric, k meterKey, kind string, ts, now time.Time) bool {
+	fresh := d.maxAge == 0 || now.Sub(ts) <= d.maxAge
+
+	d.metrics.send(ch, lastReadingMetric, prometheus.GaugeValue, float64(ts.Unix()), k.device, kind, k.id)
+
+	up := 0.0
+	if fresh {
+		up = 1
+	}
+	d.metrics.send(ch, meterUpMetric, prometheus.GaugeValue, up, k.device, kind, k.id)
+
+	return fresh
+}
+
+// collectEnergy sends the cumulative and day/week/month readings for a single
+// meter, using totalMetric and periodMetric to pick between import and export.
+func (d Data) collectEnergy(ch chan<- prometheus.Metric, totalMetric, periodMetric metric,
+	k meterKey, kind string, u bright.Usage) {
+	d.metrics.send(ch, totalMetric, prometheus.CounterValue, u.Cumulative, k.device, kind, k.id)
+
+	for period, v := range periods(u) {
+		d.metrics.send(ch, periodMetric, prometheus.GaugeValue, v, k.device, kind, k.id, period)
+	}
+}
+
+// collectGasEnergy sends the gas energy computed from the metered volume, so
+// it can be reconciled with the energy reported by the meter.
+func (d Data) collectGasEnergy(ch chan<- prometheus.Metric, k meterKey, r bright.Reading) {
+	energy := func(volume float64) float64 {
+		return bright.VolumeToEnergy(volume, d.gas.CalorificValue, d.gas.CorrectionFactor)
+	}
+
+	d.metrics.send(ch, gasEnergyComputedTotalMetric, prometheus.CounterValue, energy(r.Volume.Cumulative), k.device, k.id)
+
+	if !r.VolumePeriods {
+		return
+	}
+	for period, v := range periods(r.Volume) {
+		d.metrics.send(ch, gasEnergyComputedMetric, prometheus.GaugeValue, energy(v), k.device, k.id, period)
+	}
+}
+
+// collectPrice sends the unit rate and standing charge for a single meter, if
+// its last reading had a price.
+func (d Data) collectPrice(ch chan<- prometheus.Metric, k meterKey, kind string, p *bright.Price) {
+	if p == nil {
+		return
+	}
+	d.metrics.send(ch, unitRateMetric, prometheus.GaugeValue, p.Unitrate, k.device, kind, k.id)
+	d.metrics.send(ch, standingChargeMetric, prometheus.GaugeValue, p.StandingCharge, k.device, kind, k.id)
+}
+
+// collectCost sends the running cost for a single meter, once a price for it
+// is known.
+func (d Data) collectCost(ch chan<- prometheus.Metric, k meterKey, kind string, c meterCost) {
+	if !c.priced {
+		return
+	}
+	d.metrics.send(ch, costTotalMetric, prometheus.CounterValue, c.total, k.device, kind, k.id)
+	d.metrics.send(ch, costTodayMetric, prometheus.GaugeValue, c.today, k.device, kind, k.id)
+}
+
+// periods returns the day, week and month amounts of u keyed by their period
+// label.
+func periods(u bright.Usage) map[string]float64 {
+	return map[string]float64{
+		"day":   u.Day,
+		"week":  u.Week,
+		"month": u.Month,
+	}
+}
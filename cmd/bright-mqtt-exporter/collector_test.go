@@ -0,0 +1,182 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	bright "github.com/rk295/bright-mqtt-exporter/brightmqtt"
+)
+
+// Sample payloads, as documented in brightmqtt/types.go.
+const (
+	sampleElectricity = `{
+		"electricitymeter": {
+			"timestamp": "2022-08-25T06:16:59Z",
+			"energy": {
+				"export": {"cumulative": 0, "units": "kWh"},
+				"import": {
+					"cumulative": 4896.645, "day": 0.003, "week": 0.035, "month": 0.257,
+					"units": "kWh", "mpan": "1012400931394", "supplier": "British Gas",
+					"price": {"unitrate": 0.2924, "standingcharge": 0.3792}
+				}
+			},
+			"power": {"value": 0.481, "units": "kW"}
+		}
+	}`
+
+	sampleGas = `{
+		"gasmeter": {
+			"timestamp": "2022-08-25T06:27:51Z",
+			"energy": {
+				"import": {
+					"cumulative": 12491.78, "day": 0, "week": 14.334, "month": 109.153,
+					"units": "kWh", "cumulativevol": 1107.678, "cumulativevolunits": "m3",
+					"dayvol": 0, "weekvol": 14.334, "monthvol": 109.153,
+					"dayweekmonthvolunits": "kWh", "mprn": "3342241002", "supplier": "---",
+					"price": {"unitrate": 0.07344, "standingcharge": 0.2722}
+				}
+			}
+		}
+	}`
+
+	sampleState = `{
+		"software": "v1.8.12",
+		"timestamp": "2022-08-25T06:27:51Z",
+		"hardware": "GLOW-IHD-01-1v4-SMETS2",
+		"ethmac": "1234567890AB",
+		"smetsversion": "SMETS2",
+		"eui": "12:34:56:78:91:23:45:67",
+		"zigbee": "1.2.5",
+		"uptime": 86400,
+		"wifi": {"rssi": -61},
+		"han": {"rssi": -75, "status": "joined", "lqi": 100}
+	}`
+)
+
+// legacyLintProblems are the metrics whose legacy names break the naming
+// conventions, kept for existing dashboards.
+var legacyLintProblems = map[string]bool{
+	"bright_gas":               true,
+	"bright_cost_pounds_total": true,
+	"bright_cost_today_pounds": true,
+}
+
+// sampleData returns a Data holding the sample readings, with metrics named
+// under naming.
+func sampleData(naming string) Data {
+	d := Data{
+		readings: newStore(),
+		metrics:  newMetricSet("bright", "", naming),
+		format:   formatAuto,
+		gas:      gasConfig{CalorificValue: 39.5, CorrectionFactor: bright.StandardCorrectionFactor},
+		pipeline: newPipeline("bright", ""),
+	}
+
+	received := time.Date(2022, 8, 25, 6, 30, 0, 0, time.UTC)
+	d.handle("glow/ABCDEF/SENSOR/electricitymeter", []byte(sampleElectricity), received)
+	d.handle("glow/ABCDEF/SENSOR/gasmeter", []byte(sampleGas), received)
+	d.handle("glow/ABCDEF/STATE", []byte(sampleState), received)
+
+	return d
+}
+
+func TestCollectorLint(t *testing.T) {
+	for _, naming := range []string{namingConventional, namingLegacy, namingBoth} {
+		t.Run(naming, func(t *testing.T) {
+			d := sampleData(naming)
+
+			problems, err := testutil.CollectAndLint(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range problems {
+				if naming != namingConventional && legacyLintProblems[p.Metric] {
+					continue
+				}
+				t.Errorf("%s: %s", p.Metric, p.Text)
+			}
+		})
+	}
+}
+
+// TestCollectorRegistry checks every metric collected is described, and
+// consistently labelled, which a pedantic registry enforces.
+func TestCollectorRegistry(t *testing.T) {
+	for _, naming := range []string{namingConventional, namingLegacy, namingBoth} {
+		t.Run(naming, func(t *testing.T) {
+			d := sampleData(naming)
+
+			reg := prometheus.NewPedanticRegistry()
+			if err := reg.Register(d); err != nil {
+				t.Fatal(err)
+			}
+			mfs, err := reg.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make(map[string]bool, len(mfs))
+			for _, mf := range mfs {
+				got[mf.GetName()] = true
+			}
+
+			// Pick metrics from each message, under each scheme they
+			// should appear in.
+			want := map[string][]string{
+				namingConventional: {"bright_electricity_power_kilowatts", "bright_gas_volume_m3_total", "bright_dongle_info", "bright_cost_gbp_total"},
+				namingLegacy:       {"bright_electricity", "bright_gas", "bright_gas_volume_total", "bright_dongle_info", "bright_cost_pounds_total"},
+			}
+			want[namingBoth] = append(want[namingConventional], want[namingLegacy]...)
+
+			for _, name := range want[naming] {
+				if !got[name] {
+					t.Errorf("%s not collected", name)
+				}
+			}
+		})
+	}
+}
+
+// TestPriceLabels checks the prices are labelled with meter under their
+// conventional names, like every other metric, and keep the source label
+// under their legacy names.
+func TestPriceLabels(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(sampleData(namingBoth)); err != nil {
+		t.Fatal(err)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"bright_unit_rate_gbp_per_kwh":       "meter",
+		"bright_standing_charge_gbp_per_day": "meter",
+		"bright_price_per_unit":              "source",
+		"bright_standing_charge":             "source",
+	}
+	for _, mf := range mfs {
+		label, ok := want[mf.GetName()]
+		if !ok {
+			continue
+		}
+		delete(want, mf.GetName())
+
+		for _, m := range mf.GetMetric() {
+			var found bool
+			for _, l := range m.GetLabel() {
+				found = found || l.GetName() == label
+			}
+			if !found {
+				t.Errorf("%s has no %s label", mf.GetName(), label)
+			}
+		}
+	}
+	for name := range want {
+		t.Errorf("%s not collected", name)
+	}
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+
+	bright "github.com/rk295/bright-mqtt-exporter/brightmqtt"
+)
+
+const (
+	configFileEnv    = "CONFIG_FILE"
+	mqttHostEnv      = "MQTT_HOST"
+	mqttUserEnv      = "MQTT_USER"
+	mqttPassEnv      = "MQTT_PASS"
+	mqttTopicEnv     = "MQTT_TOPIC"
+	mqttQoSEnv       = "MQTT_QOS"
+	mqttClientIDEnv  = "MQTT_CLIENT_ID"
+	mqttTLSCAEnv     = "MQTT_TLS_CA_FILE"
+	mqttTLSCertEnv   = "MQTT_TLS_CERT_FILE"
+	mqttTLSKeyEnv    = "MQTT_TLS_KEY_FILE"
+	mqttTLSServerEnv = "MQTT_TLS_SERVER_NAME"
+	mqttTLSSkipEnv   = "MQTT_TLS_INSECURE_SKIP_VERIFY"
+	mqttTLSMinEnv    = "MQTT_TLS_MIN_VERSION"
+	messageFormatEnv = "MESSAGE_FORMAT"
+	exporterPortEnv  = "PORT"
+	readingMaxAgeEnv = "READING_MAX_AGE"
+	readyMaxAgeEnv   = "READY_MAX_AGE"
+	logLevelEnv      = "LOG_LEVEL"
+	namespaceEnv     = "METRICS_NAMESPACE"
+	subsystemEnv     = "METRICS_SUBSYSTEM"
+	namingEnv        = "METRICS_NAMING"
+	calorificEnv     = "GAS_CALORIFIC_VALUE"
+	correctionEnv    = "GAS_CORRECTION_FACTOR"
+	haEnabledEnv     = "HOMEASSISTANT_ENABLED"
+	haDiscoveryEnv   = "HOMEASSISTANT_DISCOVERY_PREFIX"
+	haStateEnv       = "HOMEASSISTANT_STATE_PREFIX"
+	republishEnv     = "REPUBLISH_ENABLED"
+	republishPfxEnv  = "REPUBLISH_PREFIX"
+	republishRetEnv  = "REPUBLISH_RETAIN"
+	republishQoSEnv  = "REPUBLISH_QOS"
+	influxURLEnv     = "INFLUXDB_URL"
+	influxOrgEnv     = "INFLUXDB_ORG"
+	influxBucketEnv  = "INFLUXDB_BUCKET"
+	influxTokenEnv   = "INFLUXDB_TOKEN"
+	influxBatchEnv   = "INFLUXDB_BATCH_SIZE"
+	influxBufferEnv  = "INFLUXDB_BUFFER_SIZE"
+	influxFlushEnv   = "INFLUXDB_FLUSH_INTERVAL"
+	recordFileEnv    = "RECORD_FILE"
+	recordSizeEnv    = "RECORD_MAX_SIZE_MB"
+	recordFilesEnv   = "RECORD_MAX_FILES"
+
+	mqttDefaultHost     = "192.168.0.50:1883"
+	mqttDefaultUser     = "admin"
+	mqttDefaultClientID = "bright-mqtt-exporter"
+	mqttDefaultTLSMin   = "1.2"
+
+	exporterDefaultPort        = "9999"
+	exporterDefaultReadyMaxAge = 10 * time.Minute
+
+	defaultLogLevel = "debug"
+
+	metricsDefaultNamespace = "bright"
+
+	haDefaultDiscoveryPrefix = "homeassistant"
+	haDefaultStatePrefix     = "bright"
+
+	republishDefaultPrefix = "energy"
+
+	influxDefaultBatchSize     = 100
+	influxDefaultBufferSize    = 10000
+	influxDefaultFlushInterval = 10 * time.Second
+
+	recordDefaultMaxSizeMB = 10
+	recordDefaultMaxFiles  = 5
+
+	redacted = "<redacted>"
+)
+
+// config is the exporter's configuration. It is built up from, in increasing
+// order of precedence, the defaults, a YAML config file, environment
+// variables and command line flags.
+type config struct {
+	MQTT     mqttConfig     `yaml:"mqtt"`
+	Exporter exporterConfig `yaml:"exporter"`
+	Metrics  metricsConfig  `yaml:"metrics"`
+	Gas      gasConfig      `yaml:"gas"`
+
+	HomeAssistant homeAssistantConfig `yaml:"homeassistant"`
+	Republish     republishConfig     `yaml:"republish"`
+	InfluxDB      influxConfig        `yaml:"influxdb"`
+	Record        recordConfig        `yaml:"record"`
+
+	LogLevel string `yaml:"log_level"`
+
+	// printConfig is set by the --print-config flag, it is never read from
+	// the file.
+	printConfig bool
+}
+
+type mqttConfig struct {
+	Host     string `yaml:"host"`
+	User     string `yaml:"user"`
+	Pass     string `yaml:"pass"`
+	Topic    string `yaml:"topic"`
+	QoS      int    `yaml:"qos"`
+	ClientID string `yaml:"client_id"`
+
+	// MessageFormat is one of formatAuto, formatLocal or formatCloud.
+	MessageFormat string `yaml:"message_format"`
+
+	TLS tlsConfig `yaml:"tls"`
+}
+
+type exporterConfig struct {
+	Port string `yaml:"port"`
+
+	// ReadingMaxAge is how old a meter's last reading may be before its
+	// series are dropped. Zero disables the check.
+	ReadingMaxAge time.Duration `yaml:"reading_max_age"`
+
+	// ReadyMaxAge is how recently a reading must have been received for
+	// /readyz to report the exporter as ready.
+	ReadyMaxAge time.Duration `yaml:"ready_max_age"`
+}
+
+type metricsConfig struct {
+	// Namespace and Subsystem prefix every metric name, either may be
+	// empty.
+	Namespace string `yaml:"namespace"`
+	Subsystem string `yaml:"subsystem"`
+
+	// Naming is one of namingConventional, namingLegacy or namingBoth. Set
+	// the namespace to uk_riviera and the subsystem to monitoring with
+	// legacy naming to get the exporter's original metric names.
+	Naming string `yaml:"naming"`
+}
+
+type gasConfig struct {
+	// CalorificValue is the gas calorific value in MJ/m3, as shown on gas
+	// bills, used to compute energy from the metered volume. Zero disables
+	// the computed energy metrics.
+	CalorificValue float64 `yaml:"calorific_value"`
+
+	// CorrectionFactor is the volume correction factor, it should only
+	// differ from the standard UK value for non-domestic supplies.
+	CorrectionFactor float64 `yaml:"correction_factor"`
+}
+
+type homeAssistantConfig struct {
+	// Enabled turns on publishing Home Assistant MQTT discovery configs and
+	// state for each meter, to the broker the exporter subscribes to.
+	Enabled bool `yaml:"enabled"`
+
+	// DiscoveryPrefix is the topic prefix Home Assistant watches for
+	// discovery configs, and StatePrefix the one state is published under.
+	DiscoveryPrefix string `yaml:"discovery_prefix"`
+	StatePrefix     string `yaml:"state_prefix"`
+}
+
+type republishConfig struct {
+	// Enabled turns on publishing each normalised reading back to the
+	// broker as a flat tree of topics under Prefix.
+	Enabled bool   `yaml:"enabled"`
+	Prefix  string `yaml:"prefix"`
+	Retain  bool   `yaml:"retain"`
+	QoS     int    `yaml:"qos"`
+}
+
+type influxConfig struct {
+	// URL is the base URL of the InfluxDB server, e.g.
+	// http://localhost:8086. Empty disables writing to InfluxDB.
+	URL    string `yaml:"url"`
+	Org    string `yaml:"org"`
+	Bucket string `yaml:"bucket"`
+	Token  string `yaml:"token"`
+
+	// Points are written in batches of up to BatchSize every FlushInterval,
+	// or sooner once a batch is full. Up to BufferSize points are held
+	// while InfluxDB can't be reached.
+	BatchSize     int           `yaml:"batch_size"`
+	BufferSize    int           `yaml:"buffer_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+type recordConfig struct {
+	// File is the path every message received is recorded to, for the
+	// replay command. Empty disables recording.
+	File string `yaml:"file"`
+
+	// The file is rotated once it reaches MaxSizeMB, keeping MaxFiles old
+	// files.
+	MaxSizeMB int `yaml:"max_size_mb"`
+	MaxFiles  int `yaml:"max_files"`
+}
+
+func defaultConfig() *config {
+	return &config{
+		MQTT: mqttConfig{
+			Host:          mqttDefaultHost,
+			User:          mqttDefaultUser,
+			ClientID:      mqttDefaultClientID,
+			MessageFormat: formatAuto,
+			TLS: tlsConfig{
+				MinVersion: mqttDefaultTLSMin,
+			},
+		},
+		Exporter: exporterConfig{
+			Port:        exporterDefaultPort,
+			ReadyMaxAge: exporterDefaultReadyMaxAge,
+		},
+		Metrics: metricsConfig{
+			Namespace: metricsDefaultNamespace,
+			Naming:    namingConventional,
+		},
+		Gas: gasConfig{
+			CorrectionFactor: bright.StandardCorrectionFactor,
+		},
+		HomeAssistant: homeAssistantConfig{
+			DiscoveryPrefix: haDefaultDiscoveryPrefix,
+			StatePrefix:     haDefaultStatePrefix,
+		},
+		Republish: republishConfig{
+			Prefix: republishDefaultPrefix,
+			Retain: true,
+		},
+		InfluxDB: influxConfig{
+			BatchSize:     influxDefaultBatchSize,
+			BufferSize:    influxDefaultBufferSize,
+			FlushInterval: influxDefaultFlushInterval,
+		},
+		Record: recordConfig{
+			MaxSizeMB: recordDefaultMaxSizeMB,
+			MaxFiles:  recordDefaultMaxFiles,
+		},
+		LogLevel: defaultLogLevel,
+	}
+}
+
+// newConfig builds the configuration from the defaults, the config file, the
+// environment and the command line flags in args, each overriding the last.
+// The config file is named by the --config flag or the CONFIG_FILE variable.
+func newConfig(name string, args []string) (*config, error) {
+	// The flags are parsed once up front to find the config file, then
+	// again once the file and environment have been loaded so only the flags
+	// which were actually given override them.
+	pre := defaultConfig()
+	var path string
+	if err := configFlags(name, pre, &path).Parse(args); err != nil {
+		return nil, err
+	}
+	if path == "" {
+		path = os.Getenv(configFileEnv)
+	}
+
+	c := defaultConfig()
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	if err := configFlags(name, c, &path).Parse(args); err != nil {
+		return nil, err
+	}
+
+	// Printing the config is most useful when it's wrong, so leave
+	// validation to the caller.
+	if c.printConfig {
+		return c, nil
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// configFlags returns a flag set which writes straight into c.
+func configFlags(name string, c *config, path *string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n\n", name)
+		fmt.Fprintf(fs.Output(), "Settings are taken from, highest precedence first, flags, environment\n")
+		fmt.Fprintf(fs.Output(), "variables, the config file and then the defaults shown below.\n\n")
+		fs.PrintDefaults()
+	}
+
+	fs.StringVar(path, "config", *path, "path to a YAML config file (env "+configFileEnv+")")
+	fs.BoolVar(&c.printConfig, "print-config", false, "print the effective config, with secrets redacted, and exit")
+
+	fs.StringVar(&c.MQTT.Host, "mqtt-host", c.MQTT.Host, "MQTT broker host:port, prefix with ssl:// or wss:// for TLS (env "+mqttHostEnv+")")
+	fs.StringVar(&c.MQTT.User, "mqtt-user", c.MQTT.User, "MQTT username (env "+mqttUserEnv+")")
+	fs.StringVar(&c.MQTT.Pass, "mqtt-pass", c.MQTT.Pass, "MQTT password (env "+mqttPassEnv+")")
+	fs.StringVar(&c.MQTT.Topic, "mqtt-topic", c.MQTT.Topic, "MQTT topic to subscribe to, wildcards are allowed (env "+mqttTopicEnv+")")
+	fs.IntVar(&c.MQTT.QoS, "mqtt-qos", c.MQTT.QoS, "MQTT subscription QoS, 0, 1 or 2 (env "+mqttQoSEnv+")")
+	fs.StringVar(&c.MQTT.ClientID, "mqtt-client-id", c.MQTT.ClientID, "MQTT client ID (env "+mqttClientIDEnv+")")
+	fs.StringVar(&c.MQTT.TLS.CAFile, "mqtt-tls-ca-file", c.MQTT.TLS.CAFile, "PEM CA bundle to verify the MQTT broker with (env "+mqttTLSCAEnv+")")
+	fs.StringVar(&c.MQTT.TLS.CertFile, "mqtt-tls-cert-file", c.MQTT.TLS.CertFile, "PEM client certificate for the MQTT broker (env "+mqttTLSCertEnv+")")
+	fs.StringVar(&c.MQTT.TLS.KeyFile, "mqtt-tls-key-file", c.MQTT.TLS.KeyFile, "PEM client key for the MQTT broker (env "+mqttTLSKeyEnv+")")
+	fs.StringVar(&c.MQTT.TLS.ServerName, "mqtt-tls-server-name", c.MQTT.TLS.ServerName, "server name for SNI and verifying the MQTT broker (env "+mqttTLSServerEnv+")")
+	fs.BoolVar(&c.MQTT.TLS.InsecureSkipVerify, "mqtt-tls-insecure-skip-verify", c.MQTT.TLS.InsecureSkipVerify, "don't verify the MQTT broker's certificate, for testing only (env "+mqttTLSSkipEnv+")")
+	fs.StringVar(&c.MQTT.TLS.MinVersion, "mqtt-tls-min-version", c.MQTT.TLS.MinVersion, "lowest TLS version to accept from the MQTT broker (env "+mqttTLSMinEnv+")")
+	fs.StringVar(&c.MQTT.MessageFormat, "message-format", c.MQTT.MessageFormat, "message format, auto, local or cloud (env "+messageFormatEnv+")")
+	fs.StringVar(&c.Exporter.Port, "port", c.Exporter.Port, "port to serve metrics on (env "+exporterPortEnv+")")
+	fs.DurationVar(&c.Exporter.ReadingMaxAge, "reading-max-age", c.Exporter.ReadingMaxAge, "drop a meter's series once its last reading is older than this, 0 disables (env "+readingMaxAgeEnv+")")
+	fs.DurationVar(&c.Exporter.ReadyMaxAge, "ready-max-age", c.Exporter.ReadyMaxAge, "report not ready on /readyz if no reading has been received for this long (env "+readyMaxAgeEnv+")")
+	fs.StringVar(&c.Metrics.Namespace, "metrics-namespace", c.Metrics.Namespace, "namespace prefixing every metric name (env "+namespaceEnv+")")
+	fs.StringVar(&c.Metrics.Subsystem, "metrics-subsystem", c.Metrics.Subsystem, "subsystem prefixing every metric name, after the namespace (env "+subsystemEnv+")")
+	fs.StringVar(&c.Metrics.Naming, "metrics-naming", c.Metrics.Naming, "metric naming scheme, conventional, legacy or both (env "+namingEnv+")")
+	fs.Float64Var(&c.Gas.CalorificValue, "gas-calorific-value", c.Gas.CalorificValue, "gas calorific value in MJ/m3 to compute energy from volume, 0 disables (env "+calorificEnv+")")
+	fs.Float64Var(&c.Gas.CorrectionFactor, "gas-correction-factor", c.Gas.CorrectionFactor, "gas volume correction factor (env "+correctionEnv+")")
+	fs.BoolVar(&c.HomeAssistant.Enabled, "homeassistant", c.HomeAssistant.Enabled, "publish Home Assistant MQTT discovery configs and state for each meter (env "+haEnabledEnv+")")
+	fs.StringVar(&c.HomeAssistant.DiscoveryPrefix, "homeassistant-discovery-prefix", c.HomeAssistant.DiscoveryPrefix, "topic prefix for Home Assistant discovery configs (env "+haDiscoveryEnv+")")
+	fs.StringVar(&c.HomeAssistant.StatePrefix, "homeassistant-state-prefix", c.HomeAssistant.StatePrefix, "topic prefix for the state published for Home Assistant (env "+haStateEnv+")")
+	fs.BoolVar(&c.Republish.Enabled, "republish", c.Republish.Enabled, "republish normalised readings as one topic per value (env "+republishEnv+")")
+	fs.StringVar(&c.Republish.Prefix, "republish-prefix", c.Republish.Prefix, "topic prefix for republished readings (env "+republishPfxEnv+")")
+	fs.BoolVar(&c.Republish.Retain, "republish-retain", c.Republish.Retain, "retain republished readings (env "+republishRetEnv+")")
+	fs.IntVar(&c.Republish.QoS, "republish-qos", c.Republish.QoS, "QoS for republished readings, 0, 1 or 2 (env "+republishQoSEnv+")")
+	fs.StringVar(&c.InfluxDB.URL, "influxdb-url", c.InfluxDB.URL, "InfluxDB URL to write readings to, empty disables (env "+influxURLEnv+")")
+	fs.StringVar(&c.InfluxDB.Org, "influxdb-org", c.InfluxDB.Org, "InfluxDB organisation (env "+influxOrgEnv+")")
+	fs.StringVar(&c.InfluxDB.Bucket, "influxdb-bucket", c.InfluxDB.Bucket, "InfluxDB bucket (env "+influxBucketEnv+")")
+	fs.StringVar(&c.InfluxDB.Token, "influxdb-token", c.InfluxDB.Token, "InfluxDB API token (env "+influxTokenEnv+")")
+	fs.IntVar(&c.InfluxDB.BatchSize, "influxdb-batch-size", c.InfluxDB.BatchSize, "most points to write to InfluxDB in one request (env "+influxBatchEnv+")")
+	fs.IntVar(&c.InfluxDB.BufferSize, "influxdb-buffer-size", c.InfluxDB.BufferSize, "most points to hold while InfluxDB is unreachable (env "+influxBufferEnv+")")
+	fs.DurationVar(&c.InfluxDB.FlushInterval, "influxdb-flush-interval", c.InfluxDB.FlushInterval, "how often to write buffered points to InfluxDB (env "+influxFlushEnv+")")
+	fs.StringVar(&c.Record.File, "record-file", c.Record.File, "record every message received to this file for replay, empty disables (env "+recordFileEnv+")")
+	fs.IntVar(&c.Record.MaxSizeMB, "record-max-size-mb", c.Record.MaxSizeMB, "rotate the recording once it reaches this size (env "+recordSizeEnv+")")
+	fs.IntVar(&c.Record.MaxFiles, "record-max-files", c.Record.MaxFiles, "number of rotated recordings to keep (env "+recordFilesEnv+")")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "log level (env "+logLevelEnv+")")
+
+	return fs
+}
+
+// loadFile overrides c with any settings in the YAML file at path.
+func (c *config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	log.Debugf("loaded config file %s", path)
+
+	return nil
+}
+
+// loadEnv overrides c with any settings in the environment.
+func (c *config) loadEnv() error {
+	for env, dst := range map[string]*string{
+		mqttHostEnv:      &c.MQTT.Host,
+		mqttUserEnv:      &c.MQTT.User,
+		mqttPassEnv:      &c.MQTT.Pass,
+		mqttTopicEnv:     &c.MQTT.Topic,
+		mqttClientIDEnv:  &c.MQTT.ClientID,
+		mqttTLSCAEnv:     &c.MQTT.TLS.CAFile,
+		mqttTLSCertEnv:   &c.MQTT.TLS.CertFile,
+		mqttTLSKeyEnv:    &c.MQTT.TLS.KeyFile,
+		mqttTLSServerEnv: &c.MQTT.TLS.ServerName,
+		mqttTLSMinEnv:    &c.MQTT.TLS.MinVersion,
+		messageFormatEnv: &c.MQTT.MessageFormat,
+		exporterPortEnv:  &c.Exporter.Port,
+		logLevelEnv:      &c.LogLevel,
+		namespaceEnv:     &c.Metrics.Namespace,
+		subsystemEnv:     &c.Metrics.Subsystem,
+		namingEnv:        &c.Metrics.Naming,
+		haDiscoveryEnv:   &c.HomeAssistant.DiscoveryPrefix,
+		haStateEnv:       &c.HomeAssistant.StatePrefix,
+		republishPfxEnv:  &c.Republish.Prefix,
+		influxURLEnv:     &c.InfluxDB.URL,
+		influxOrgEnv:     &c.InfluxDB.Org,
+		influxBucketEnv:  &c.InfluxDB.Bucket,
+		influxTokenEnv:   &c.InfluxDB.Token,
+		recordFileEnv:    &c.Record.File,
+	} {
+		if v := os.Getenv(env); v != "" {
+			*dst = v
+		}
+	}
+
+	for env, dst := range map[string]*int{
+		mqttQoSEnv:      &c.MQTT.QoS,
+		republishQoSEnv: &c.Republish.QoS,
+		influxBatchEnv:  &c.InfluxDB.BatchSize,
+		influxBufferEnv: &c.InfluxDB.BufferSize,
+		recordSizeEnv:   &c.Record.MaxSizeMB,
+		recordFilesEnv:  &c.Record.MaxFiles,
+	} {
+		if v := os.Getenv(env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("the %s variable must be a number: %w", env, err)
+			}
+			*dst = n
+		}
+	}
+
+	for env, dst := range map[string]*bool{
+		mqttTLSSkipEnv:  &c.MQTT.TLS.InsecureSkipVerify,
+		haEnabledEnv:    &c.HomeAssistant.Enabled,
+		republishEnv:    &c.Republish.Enabled,
+		republishRetEnv: &c.Republish.Retain,
+	} {
+		if v := os.Getenv(env); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("the %s variable must be true or false: %w", env, err)
+			}
+			*dst = b
+		}
+	}
+
+	for env, dst := range map[string]*float64{
+		calorificEnv:  &c.Gas.CalorificValue,
+		correctionEnv: &c.Gas.CorrectionFactor,
+	} {
+		if v := os.Getenv(env); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return fmt.Errorf("the %s variable must be a number: %w", env, err)
+			}
+			*dst = f
+		}
+	}
+
+	for env, dst := range map[string]*time.Duration{
+		readingMaxAgeEnv: &c.Exporter.ReadingMaxAge,
+		readyMaxAgeEnv:   &c.Exporter.ReadyMaxAge,
+		influxFlushEnv:   &c.InfluxDB.FlushInterval,
+	} {
+		if v := os.Getenv(env); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("the %s variable must be a duration such as 10m: %w", env, err)
+			}
+			*dst = d
+		}
+	}
+
+	return nil
+}
+
+// validate checks the final config, after every source has been applied.
+func (c *config) validate() error {
+	if c.MQTT.Pass == "" {
+		return fmt.Errorf("the MQTT password must be set with --mqtt-pass, %s or mqtt.pass in the config file", mqttPassEnv)
+	}
+
+	if c.MQTT.Topic == "" {
+		return fmt.Errorf("the MQTT topic must be set with --mqtt-topic, %s or mqtt.topic in the config file", mqttTopicEnv)
+	}
+
+	if c.MQTT.QoS < 0 || c.MQTT.QoS > 2 {
+		return fmt.Errorf("the MQTT QoS must be 0, 1 or 2, not %d", c.MQTT.QoS)
+	}
+
+	if err := c.MQTT.TLS.validate(); err != nil {
+		return err
+	}
+
+	switch c.MQTT.MessageFormat {
+	case formatAuto, formatLocal, formatCloud:
+	default:
+		return fmt.Errorf("the message format must be one of %s, %s or %s, not %q", formatAuto, formatLocal, formatCloud, c.MQTT.MessageFormat)
+	}
+
+	if port, err := strconv.Atoi(c.Exporter.Port); err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("the exporter port must be a number between 1 and 65535, not %q", c.Exporter.Port)
+	}
+
+	if c.Exporter.ReadingMaxAge < 0 {
+		return fmt.Errorf("the reading max age must not be negative, not %s", c.Exporter.ReadingMaxAge)
+	}
+
+	if c.Exporter.ReadyMaxAge <= 0 {
+		return fmt.Errorf("the ready max age must be positive, not %s", c.Exporter.ReadyMaxAge)
+	}
+
+	switch c.Metrics.Naming {
+	case namingConventional, namingLegacy, namingBoth:
+	default:
+		return fmt.Errorf("the metric naming must be one of %s, %s or %s, not %q", namingConventional, namingLegacy, namingBoth, c.Metrics.Naming)
+	}
+
+	if c.Gas.CalorificValue < 0 {
+		return fmt.Errorf("the gas calorific value must not be negative, not %v", c.Gas.CalorificValue)
+	}
+
+	if c.Gas.CorrectionFactor <= 0 {
+		return fmt.Errorf("the gas correction factor must be positive, not %v", c.Gas.CorrectionFactor)
+	}
+
+	if c.HomeAssistant.Enabled {
+		for name, prefix := range map[string]string{
+			"discovery": c.HomeAssistant.DiscoveryPrefix,
+			"state":     c.HomeAssistant.StatePrefix,
+		} {
+			if prefix == "" || strings.ContainsAny(prefix, "+#") {
+				return fmt.Errorf("the Home Assistant %s prefix must be a topic without wildcards, not %q", name, prefix)
+			}
+		}
+	}
+
+	if c.Republish.Enabled {
+		if c.Republish.Prefix == "" || strings.ContainsAny(c.Republish.Prefix, "+#") {
+			return fmt.Errorf("the republish prefix must be a topic without wildcards, not %q", c.Republish.Prefix)
+		}
+		if c.Republish.QoS < 0 || c.Republish.QoS > 2 {
+			return fmt.Errorf("the republish QoS must be 0, 1 or 2, not %d", c.Republish.QoS)
+		}
+	}
+
+	if err := c.InfluxDB.validate(); err != nil {
+		return err
+	}
+
+	if c.Record.File != "" {
+		if c.Record.MaxSizeMB < 1 {
+			return fmt.Errorf("the recording max size must be at least 1MB, not %dMB", c.Record.MaxSizeMB)
+		}
+		if c.Record.MaxFiles < 0 {
+			return fmt.Errorf("the number of recordings to keep must not be negative, not %d", c.Record.MaxFiles)
+		}
+	}
+
+	if _, err := log.ParseLevel(c.LogLevel); err != nil {
+		return fmt.Errorf("invalid log level: %w", err)
+	}
+
+	return nil
+}
+
+// validate checks the InfluxDB settings, if writing to InfluxDB is enabled.
+func (c influxConfig) validate() error {
+	if c.URL == "" {
+		return nil
+	}
+
+	if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("the InfluxDB URL must be an http or https URL, not %q", c.URL)
+	}
+
+	if c.Org == "" || c.Bucket == "" {
+		return fmt.Errorf("the InfluxDB org and bucket must be set to write to InfluxDB")
+	}
+
+	if c.BatchSize < 1 {
+		return fmt.Errorf("the InfluxDB batch size must be positive, not %d", c.BatchSize)
+	}
+
+	if c.BufferSize < c.BatchSize {
+		return fmt.Errorf("the InfluxDB buffer size must be at least the batch size of %d, not %d", c.BatchSize, c.BufferSize)
+	}
+
+	if c.FlushInterval <= 0 {
+		return fmt.Errorf("the InfluxDB flush interval must be positive, not %s", c.FlushInterval)
+	}
+
+	return nil
+}
+
+// print writes c to w as YAML, with any secrets redacted.
+func (c config) print(w io.Writer) error {
+	if c.MQTT.Pass != "" {
+		c.MQTT.Pass = redacted
+	}
+	if c.InfluxDB.Token != "" {
+		c.InfluxDB.Token = redacted
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	return enc.Close()
+}
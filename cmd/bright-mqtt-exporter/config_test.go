@@ -0,0 +1,224 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestNewConfigPrecedence checks each source overrides the last: defaults,
+// then the config file, then the environment, then flags.
+func TestNewConfigPrecedence(t *testing.T) {
+	const file = `
+mqtt:
+  host: file:1883
+  pass: file-pass
+  topic: glow/#
+exporter:
+  port: "9100"
+  reading_max_age: 5m
+`
+
+	tests := []struct {
+		name   string
+		file   string
+		env    map[string]string
+		args   []string
+		host   string
+		port   string
+		maxAge time.Duration
+	}{
+		{
+			name: "defaults",
+			args: []string{"--mqtt-pass", "flag-pass", "--mqtt-topic", "glow/#"},
+			host: mqttDefaultHost,
+			port: exporterDefaultPort,
+		},
+		{
+			name:   "file over defaults",
+			file:   file,
+			host:   "file:1883",
+			port:   "9100",
+			maxAge: 5 * time.Minute,
+		},
+		{
+			name:   "env over file",
+			file:   file,
+			env:    map[string]string{mqttHostEnv: "env:1883", readingMaxAgeEnv: "10m"},
+			host:   "env:1883",
+			port:   "9100",
+			maxAge: 10 * time.Minute,
+		},
+		{
+			name:   "flags over env",
+			file:   file,
+			env:    map[string]string{mqttHostEnv: "env:1883", readingMaxAgeEnv: "10m"},
+			args:   []string{"--mqtt-host", "flag:1883", "--port", "9200"},
+			host:   "flag:1883",
+			port:   "9200",
+			maxAge: 10 * time.Minute,
+		},
+		{
+			name: "env only",
+			env: map[string]string{
+				mqttPassEnv:     "env-pass",
+				mqttTopicEnv:    "glow/#",
+				exporterPortEnv: "9300",
+			},
+			host: mqttDefaultHost,
+			port: "9300",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Start from a clean environment, as empty variables are
+			// ignored.
+			for _, env := range []string{configFileEnv, mqttHostEnv, mqttPassEnv, mqttTopicEnv, exporterPortEnv, readingMaxAgeEnv} {
+				t.Setenv(env, "")
+			}
+			for env, v := range tt.env {
+				t.Setenv(env, v)
+			}
+
+			if tt.file != "" {
+				path := filepath.Join(t.TempDir(), "config.yaml")
+				if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				t.Setenv(configFileEnv, path)
+			}
+
+			c, err := newConfig("test", tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.MQTT.Host != tt.host {
+				t.Errorf("host = %q, want %q", c.MQTT.Host, tt.host)
+			}
+			if c.Exporter.Port != tt.port {
+				t.Errorf("port = %q, want %q", c.Exporter.Port, tt.port)
+			}
+			if c.Exporter.ReadingMaxAge != tt.maxAge {
+				t.Errorf("reading max age = %s, want %s", c.Exporter.ReadingMaxAge, tt.maxAge)
+			}
+		})
+	}
+}
+
+func TestNewConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+	}{
+		{
+			name: "missing password",
+			args: []string{"--mqtt-topic", "glow/#"},
+		},
+		{
+			name: "unknown file field",
+			file: "mqtt:\n  hots: broker:1883\n",
+			args: []string{"--mqtt-pass", "pass", "--mqtt-topic", "glow/#"},
+		},
+		{
+			name: "bad env number",
+			env:  map[string]string{mqttQoSEnv: "one"},
+			args: []string{"--mqtt-pass", "pass", "--mqtt-topic", "glow/#"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, env := range []string{configFileEnv, mqttPassEnv, mqttTopicEnv, mqttQoSEnv} {
+				t.Setenv(env, "")
+			}
+			for env, v := range tt.env {
+				t.Setenv(env, v)
+			}
+
+			args := tt.args
+			if tt.file != "" {
+				path := filepath.Join(t.TempDir(), "config.yaml")
+				if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				args = append([]string{"--config", path}, args...)
+			}
+
+			if _, err := newConfig("test", args); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(c *config)
+		wantErr bool
+	}{
+		{name: "valid", change: func(c *config) {}},
+		{name: "no password", change: func(c *config) { c.MQTT.Pass = "" }, wantErr: true},
+		{name: "no topic", change: func(c *config) { c.MQTT.Topic = "" }, wantErr: true},
+		{name: "QoS too high", change: func(c *config) { c.MQTT.QoS = 3 }, wantErr: true},
+		{name: "cert without key", change: func(c *config) { c.MQTT.TLS.CertFile = "client.pem" }, wantErr: true},
+		{name: "unknown TLS version", change: func(c *config) { c.MQTT.TLS.MinVersion = "1.4" }, wantErr: true},
+		{name: "unknown message format", change: func(c *config) { c.MQTT.MessageFormat = "json" }, wantErr: true},
+		{name: "port not a number", change: func(c *config) { c.Exporter.Port = "http" }, wantErr: true},
+		{name: "port out of range", change: func(c *config) { c.Exporter.Port = "65536" }, wantErr: true},
+		{name: "negative reading max age", change: func(c *config) { c.Exporter.ReadingMaxAge = -time.Second }, wantErr: true},
+		{name: "zero ready max age", change: func(c *config) { c.Exporter.ReadyMaxAge = 0 }, wantErr: true},
+		{name: "unknown naming", change: func(c *config) { c.Metrics.Naming = "new" }, wantErr: true},
+		{name: "negative calorific value", change: func(c *config) { c.Gas.CalorificValue = -1 }, wantErr: true},
+		{name: "zero correction factor", change: func(c *config) { c.Gas.CorrectionFactor = 0 }, wantErr: true},
+		{
+			name: "Home Assistant wildcard prefix",
+			change: func(c *config) {
+				c.HomeAssistant.Enabled = true
+				c.HomeAssistant.StatePrefix = "bright/#"
+			},
+			wantErr: true,
+		},
+		{
+			// The prefixes aren't used unless Home Assistant is enabled.
+			name:   "Home Assistant disabled",
+			change: func(c *config) { c.HomeAssistant.StatePrefix = "" },
+		},
+		{
+			name: "republish QoS too high",
+			change: func(c *config) {
+				c.Republish.Enabled = true
+				c.Republish.QoS = 3
+			},
+			wantErr: true,
+		},
+		{name: "InfluxDB URL not http", change: func(c *config) { c.InfluxDB.URL = "udp://influx:8089" }, wantErr: true},
+		{
+			name: "recording too small",
+			change: func(c *config) {
+				c.Record.File = "messages.jsonl"
+				c.Record.MaxSizeMB = 0
+			},
+			wantErr: true,
+		},
+		{name: "unknown log level", change: func(c *config) { c.LogLevel = "chatty" }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaultConfig()
+			c.MQTT.Pass = "pass"
+			c.MQTT.Topic = "glow/#"
+			tt.change(c)
+
+			err := c.validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
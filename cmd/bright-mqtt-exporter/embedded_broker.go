@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// embeddedConnectTimeout is how long a client has to send CONNECT, and
+	// embeddedWriteTimeout how long a slow client may hold up delivery.
+	embeddedConnectTimeout = 10 * time.Second
+	embeddedWriteTimeout   = 10 * time.Second
+)
+
+// embeddedBroker is a minimal MQTT 3.1.1 broker, enough for the simulate
+// command to run with the exporter fully offline. Messages are delivered at
+// QoS 0 whatever QoS they were published or subscribed with, and retained
+// messages are kept in memory. There is no authentication, any username and
+// password are accepted, and no persistent sessions or wills.
+type embeddedBroker struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	clients  map[*embeddedClient]struct{}
+	retained map[string][]byte
+}
+
+type embeddedClient struct {
+	conn net.Conn
+	id   string
+
+	// filters are the client's subscriptions, guarded by the broker's lock.
+	filters map[string]struct{}
+
+	// wmu serialises writes, as messages can be delivered to the client
+	// from any other client's goroutine.
+	wmu sync.Mutex
+}
+
+// listenEmbeddedBroker starts a broker listening on addr, e.g. ":1883".
+func listenEmbeddedBroker(addr string) (*embeddedBroker, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("starting embedded broker: %w", err)
+	}
+
+	b := &embeddedBroker{
+		listener: l,
+		clients:  make(map[*embeddedClient]struct{}),
+		retained: make(map[string][]byte),
+	}
+	go b.serve()
+
+	return b, nil
+}
+
+// url returns the URL for clients on this host to connect to the broker at.
+func (b *embeddedBroker) url() string {
+	port := b.listener.Addr().(*net.TCPAddr).Port
+	return fmt.Sprintf("tcp://127.0.0.1:%d", port)
+}
+
+// close stops accepting connections and disconnects every client.
+func (b *embeddedBroker) close() error {
+	err := b.listener.Close()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		c.conn.Close()
+	}
+
+	return err
+}
+
+func (b *embeddedBroker) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Warnf("broker: accepting connection: %v", err)
+			continue
+		}
+		go b.handle(conn)
+	}
+}
+
+// handle serves a single client connection until it disconnects.
+func (b *embeddedBroker) handle(conn net.Conn) {
+	defer conn.Close()
+
+	c, keepAlive, err := b.connect(conn)
+	if err != nil {
+		log.Warnf("broker: %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	log.Debugf("broker: client %s connected from %s", c.id, conn.RemoteAddr())
+
+	defer func() {
+		b.mu.Lock()
+		delete(b.clients, c)
+		b.mu.Unlock()
+		log.Debugf("broker: client %s disconnected", c.id)
+	}()
+
+	for {
+		// Clients must send something at least every keep alive period,
+		// with the spec's grace of half as long again.
+		if keepAlive > 0 {
+			conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		}
+
+		pkt, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+
+		switch p := pkt.(type) {
+		case *packets.PublishPacket:
+			switch p.Qos {
+			case 1:
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				err = c.write(ack)
+			case 2:
+				rec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				rec.MessageID = p.MessageID
+				err = c.write(rec)
+			}
+			b.publish(p.TopicName, p.Payload, p.Retain)
+
+		case *packets.PubrelPacket:
+			comp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			comp.MessageID = p.MessageID
+			err = c.write(comp)
+
+		case *packets.SubscribePacket:
+			err = b.subscribe(c, p)
+
+		case *packets.UnsubscribePacket:
+			b.mu.Lock()
+			for _, f := range p.Topics {
+				delete(c.filters, f)
+			}
+			b.mu.Unlock()
+
+			ack := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ack.MessageID = p.MessageID
+			err = c.write(ack)
+
+		case *packets.PingreqPacket:
+			err = c.write(packets.NewControlPacket(packets.Pingresp))
+
+		case *packets.DisconnectPacket:
+			return
+
+		default:
+			log.Warnf("broker: client %s sent unexpected %s", c.id, pkt)
+			return
+		}
+
+		if err != nil {
+			log.Warnf("broker: writing to client %s: %v", c.id, err)
+			return
+		}
+	}
+}
+
+// connect reads the client's CONNECT packet and accepts it.
+func (b *embeddedBroker) connect(conn net.Conn) (*embeddedClient, time.Duration, error) {
+	conn.SetReadDeadline(time.Now().Add(embeddedConnectTimeout))
+	pkt, err := packets.ReadPacket(conn)
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading CONNECT: %w", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	p, ok := pkt.(*packets.ConnectPacket)
+	if !ok {
+		return nil, 0, fmt.Errorf("expected CONNECT, got %s", pkt)
+	}
+
+	c := &embeddedClient{conn: conn, id: p.ClientIdentifier, filters: make(map[string]struct{})}
+
+	ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	ack.ReturnCode = p.Validate()
+	if err := c.write(ack); err != nil {
+		return nil, 0, err
+	}
+	if ack.ReturnCode != packets.Accepted {
+		return nil, 0, fmt.Errorf("refused connection: %s", packets.ConnackReturnCodes[ack.ReturnCode])
+	}
+
+	b.mu.Lock()
+	b.clients[c] = struct{}{}
+	b.mu.Unlock()
+
+	return c, time.Duration(p.Keepalive) * time.Second, nil
+}
+
+// subscribe adds the client's subscriptions and sends it any retained
+// messages they match.
+func (b *embeddedBroker) subscribe(c *embeddedClient, p *packets.SubscribePacket) error {
+	ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	ack.MessageID = p.MessageID
+
+	var retained []*packets.PublishPacket
+	b.mu.Lock()
+	for _, f := range p.Topics {
+		c.filters[f] = struct{}{}
+		ack.ReturnCodes = append(ack.ReturnCodes, 0)
+
+		for topic, payload := range b.retained {
+			if topicMatches(f, topic) {
+				retained = append(retained, newEmbeddedPublish(topic, payload, true))
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	if err := c.write(ack); err != nil {
+		return err
+	}
+	for _, pub := range retained {
+		if err := c.write(pub); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// publish delivers a message to every client subscribed to topic, and keeps
+// it for future subscribers if it's retained. A retained message with an
+// empty payload clears the topic's retained message.
+func (b *embeddedBroker) publish(topic string, payload []byte, retain bool) {
+	var subscribers []*embeddedClient
+
+	b.mu.Lock()
+	if retain {
+		if len(payload) == 0 {
+			delete(b.retained, topic)
+		} else {
+			b.retained[topic] = payload
+		}
+	}
+	for c := range b.clients {
+		for f := range c.filters {
+			if topicMatches(f, topic) {
+				subscribers = append(subscribers, c)
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	pub := newEmbeddedPublish(topic, payload, false)
+	for _, c := range subscribers {
+		if err := c.write(pub); err != nil {
+			log.Warnf("broker: delivering to client %s: %v", c.id, err)
+			c.conn.Close()
+		}
+	}
+}
+
+func newEmbeddedPublish(topic string, payload []byte, retain bool) *packets.PublishPacket {
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = topic
+	pub.Payload = payload
+	pub.Retain = retain
+	return pub
+}
+
+func (c *embeddedClient) write(p packets.ControlPacket) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(embeddedWriteTimeout))
+	return p.Write(c.conn)
+}
+
+// topicMatches reports whether topic matches the subscription filter, which
+// may contain + and # wildcards. As the spec requires, wildcards at the start
+// of a filter don't match topics starting with $.
+func topicMatches(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if level != "+" && level != t[i] {
+			return false
+		}
+	}
+
+	return len(f) == len(t)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"glow/ABCDEF/STATE", "glow/ABCDEF/STATE", true},
+		{"glow/ABCDEF/STATE", "glow/ABCDEF/SENSOR", false},
+		{"glow/+/STATE", "glow/ABCDEF/STATE", true},
+		{"glow/+/STATE", "glow/ABCDEF/SENSOR/gasmeter", false},
+		{"glow/+", "glow/ABCDEF/STATE", false},
+		{"glow/+/+/+", "glow/ABCDEF/SENSOR/gasmeter", true},
+		{"glow/#", "glow/ABCDEF/SENSOR/gasmeter", true},
+		// # also matches the level above it.
+		{"glow/#", "glow", true},
+		{"glow/ABCDEF/#", "glow/FEDCBA/STATE", false},
+		{"#", "glow/ABCDEF/STATE", true},
+		{"+/+", "/glow", true},
+		{"glow/STATE", "glow/STATE/", false},
+		// Wildcards at the start don't match system topics.
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+	}
+
+	for _, tt := range tests {
+		if got := topicMatches(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("topicMatches(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+// TestEmbeddedBroker subscribes to the broker and checks the subscription is
+// acknowledged, retained messages are delivered and cleared, and only
+// matching messages are delivered after that.
+func TestEmbeddedBroker(t *testing.T) {
+	b, err := listenEmbeddedBroker("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.close()
+
+	pub := dialEmbeddedBroker(t, b, "pub")
+	publishTo(t, pub, "glow/ABCDEF/STATE", "state", true)
+	publishTo(t, pub, "glow/ABCDEF/SENSOR/gasmeter", "gas", true)
+	publishTo(t, pub, "glow/ABCDEF/SENSOR/gasmeter", "", true)
+	// The broker handles each client's packets in order, so once it has
+	// answered a ping it has stored the retained messages.
+	writePacket(t, pub, packets.NewControlPacket(packets.Pingreq))
+	if _, ok := readPacket(t, pub).(*packets.PingrespPacket); !ok {
+		t.Fatal("expected PINGRESP")
+	}
+
+	sub := dialEmbeddedBroker(t, b, "sub")
+	s := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	s.MessageID = 1
+	s.Topics = []string{"glow/+/STATE", "glow/ABCDEF/SENSOR/#"}
+	s.Qoss = []byte{0, 1}
+	writePacket(t, sub, s)
+
+	ack, ok := readPacket(t, sub).(*packets.SubackPacket)
+	if !ok {
+		t.Fatal("expected SUBACK")
+	}
+	if ack.MessageID != 1 || !reflect.DeepEqual(ack.ReturnCodes, []byte{0, 0}) {
+		t.Errorf("SUBACK for message %d with return codes %v, want 1 and [0 0]", ack.MessageID, ack.ReturnCodes)
+	}
+
+	// The cleared gas message isn't delivered, so the retained state
+	// message is followed by the live electricity one.
+	publishTo(t, pub, "glow/ABCDEF/ELECTRICITY", "other", false)
+	publishTo(t, pub, "glow/ABCDEF/SENSOR/electricitymeter", "electricity", false)
+
+	for _, want := range []struct {
+		topic, payload string
+		retain         bool
+	}{
+		{"glow/ABCDEF/STATE", "state", true},
+		{"glow/ABCDEF/SENSOR/electricitymeter", "electricity", false},
+	} {
+		p, ok := readPacket(t, sub).(*packets.PublishPacket)
+		if !ok {
+			t.Fatal("expected PUBLISH")
+		}
+		if p.TopicName != want.topic || string(p.Payload) != want.payload || p.Retain != want.retain {
+			t.Errorf("got %s %q retained %v, want %s %q retained %v",
+				p.TopicName, p.Payload, p.Retain, want.topic, want.payload, want.retain)
+		}
+	}
+}
+
+// dialEmbeddedBroker connects a client to b, failing the test unless the
+// connection is accepted.
+func dialEmbeddedBroker(t *testing.T, b *embeddedBroker, id string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", b.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	c.ProtocolName = "MQTT"
+	c.ProtocolVersion = 4
+	c.ClientIdentifier = id
+	c.CleanSession = true
+	writePacket(t, conn, c)
+
+	ack, ok := readPacket(t, conn).(*packets.ConnackPacket)
+	if !ok {
+		t.Fatal("expected CONNACK")
+	}
+	if ack.ReturnCode != packets.Accepted {
+		t.Fatalf("connection refused: %s", packets.ConnackReturnCodes[ack.ReturnCode])
+	}
+
+	return conn
+}
+
+func publishTo(t *testing.T, conn net.Conn, topic, payload string, retain bool) {
+	t.Helper()
+	writePacket(t, conn, newEmbeddedPublish(topic, []byte(payload), retain))
+}
+
+func writePacket(t *testing.T, conn net.Conn, p packets.ControlPacket) {
+	t.Helper()
+	if err := p.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readPacket(t *testing.T, conn net.Conn) packets.ControlPacket {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p, err := packets.ReadPacket(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
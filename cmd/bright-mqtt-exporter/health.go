@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	statusOK          = "ok"
+	statusUnavailable = "unavailable"
+)
+
+// healthStatus is the JSON body served by /healthz and /readyz.
+type healthStatus struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+// healthCheck is the result of a single readiness check.
+type healthCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// healthzHandler reports the process is alive, it always succeeds.
+func healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	writeHealth(w, healthStatus{Status: statusOK})
+}
+
+// readyzHandler reports whether the exporter is connected and subscribed to
+// the broker, and has received a reading within maxAge.
+func readyzHandler(b *broker, s *store, maxAge time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		checks := map[string]healthCheck{
+			"mqtt_connected":  {Detail: "not connected to the MQTT broker"},
+			"mqtt_subscribed": {Detail: fmt.Sprintf("not subscribed to %s", b.topic)},
+		}
+		if b.isConnected() {
+			checks["mqtt_connected"] = healthCheck{OK: true, Detail: "connected to the MQTT broker"}
+		}
+		if b.isSubscribed() {
+			checks["mqtt_subscribed"] = healthCheck{OK: true, Detail: fmt.Sprintf("subscribed to %s", b.topic)}
+		}
+
+		reading := healthCheck{Detail: "no readings received yet"}
+		if last := s.lastReceived(); !last.IsZero() {
+			age := time.Since(last).Round(time.Second)
+			reading.OK = age <= maxAge
+			reading.Detail = fmt.Sprintf("last reading received %s ago, limit is %s", age, maxAge)
+		}
+		checks["recent_reading"] = reading
+
+		status := healthStatus{Status: statusOK, Checks: checks}
+		for _, c := range checks {
+			if !c.OK {
+				status.Status = statusUnavailable
+			}
+		}
+
+		writeHealth(w, status)
+	}
+}
+
+func writeHealth(w http.ResponseWriter, status healthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	if status.Status != statusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Errorf("writing health status: %v", err)
+	}
+}
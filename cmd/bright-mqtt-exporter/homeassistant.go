@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+
+	bright "github.com/rk295/bright-mqtt-exporter/brightmqtt"
+)
+
+// haSensor is a single reading from a meter, announced to Home Assistant as
+// its own sensor entity.
+type haSensor struct {
+	// field is the key of the reading in the state message, and suffixes
+	// the entity's IDs.
+	field       string
+	name        string
+	deviceClass string
+	stateClass  string
+	unit        string
+}
+
+// Home Assistant's Energy dashboard wants energy sensors with the energy
+// device class and total_increasing state class, and takes prices from any
+// sensor in a currency per kWh.
+var (
+	haElectricitySensors = []haSensor{
+		{field: "power_kw", name: "Power", deviceClass: "power", stateClass: "measurement", unit: bright.Kilowatts},
+		{field: "import_kwh", name: "Energy import", deviceClass: "energy", stateClass: "total_increasing", unit: bright.KilowattHours},
+		{field: "export_kwh", name: "Energy export", deviceClass: "energy", stateClass: "total_increasing", unit: bright.KilowattHours},
+		{field: "unit_rate_gbp_per_kwh", name: "Unit rate", stateClass: "measurement", unit: "GBP/kWh"},
+		{field: "standing_charge_gbp_per_day", name: "Standing charge", stateClass: "measurement", unit: "GBP/d"},
+	}
+
+	haGasSensors = []haSensor{
+		{field: "import_kwh", name: "Energy import", deviceClass: "energy", stateClass: "total_increasing", unit: bright.KilowattHours},
+		{field: "volume_m3", name: "Volume", deviceClass: "gas", stateClass: "total_increasing", unit: "m³"},
+		{field: "unit_rate_gbp_per_kwh", name: "Unit rate", stateClass: "measurement", unit: "GBP/kWh"},
+		{field: "standing_charge_gbp_per_day", name: "Standing charge", stateClass: "measurement", unit: "GBP/d"},
+	}
+)
+
+// haUnsafe matches the characters Home Assistant doesn't allow in discovery
+// topic IDs.
+var haUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// haDiscovery is the payload of a Home Assistant MQTT discovery config
+// message for a sensor.
+type haDiscovery struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	StateTopic        string   `json:"state_topic"`
+	ValueTemplate     string   `json:"value_template"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	StateClass        string   `json:"state_class,omitempty"`
+	UnitOfMeasurement string   `json:"unit_of_measurement,omitempty"`
+	Device            haDevice `json:"device"`
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	ViaDevice    string   `json:"via_device,omitempty"`
+}
+
+// haElectricityState and haGasState are the normalised state messages the
+// discovered sensors read their values from. The price is null when the
+// reading had none, which Home Assistant shows as unknown.
+type haElectricityState struct {
+	Power          float64   `json:"power_kw"`
+	Import         float64   `json:"import_kwh"`
+	Export         float64   `json:"export_kwh"`
+	UnitRate       *float64  `json:"unit_rate_gbp_per_kwh"`
+	StandingCharge *float64  `json:"standing_charge_gbp_per_day"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+type haGasState struct {
+	Import         float64   `json:"import_kwh"`
+	Volume         float64   `json:"volume_m3"`
+	UnitRate       *float64  `json:"unit_rate_gbp_per_kwh"`
+	StandingCharge *float64  `json:"standing_charge_gbp_per_day"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+// homeAssistant is a sink which announces each meter to Home Assistant with
+// MQTT discovery the first time it's seen, then publishes its normalised
+// state on every reading. Both are retained so Home Assistant picks them up
+// when it restarts.
+type homeAssistant struct {
+	client          mqtt.Client
+	discoveryPrefix string
+	statePrefix     string
+
+	mu        sync.Mutex
+	announced map[meterKey]bool
+}
+
+func newHomeAssistant(client mqtt.Client, c homeAssistantConfig) *homeAssistant {
+	return &homeAssistant{
+		client:          client,
+		discoveryPrefix: c.DiscoveryPrefix,
+		statePrefix:     c.StatePrefix,
+		announced:       make(map[meterKey]bool),
+	}
+}
+
+func (h *homeAssistant) write(k meterKey, r bright.Reading) {
+	kind := string(r.Kind)
+	topic := h.stateTopic(k, kind)
+
+	var unitRate, standingCharge *float64
+	if r.Price != nil {
+		unitRate, standingCharge = &r.Price.Unitrate, &r.Price.StandingCharge
+	}
+
+	var state interface{}
+	switch r.Kind {
+	case bright.KindElectricity:
+		h.announce(k, kind, topic, haElectricitySensors)
+		state = haElectricityState{
+			Power:          r.Power,
+			Import:         r.Import.Cumulative,
+			Export:         r.Export.Cumulative,
+			UnitRate:       unitRate,
+			StandingCharge: standingCharge,
+			Timestamp:      r.Timestamp,
+		}
+	case bright.KindGas:
+		h.announce(k, kind, topic, haGasSensors)
+		state = haGasState{
+			Import:         r.Import.Cumulative,
+			Volume:         r.Volume.Cumulative,
+			UnitRate:       unitRate,
+			StandingCharge: standingCharge,
+			Timestamp:      r.Timestamp,
+		}
+	default:
+		return
+	}
+
+	go wait(topic, h.publish(topic, state))
+}
+
+func (h *homeAssistant) stateTopic(k meterKey, kind string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", h.statePrefix, haID(k.device), haID(k.id), kind)
+}
+
+// announce publishes the discovery config for each of a meter's sensors,
+// unless it has already been announced.
+func (h *homeAssistant) announce(k meterKey, kind, stateTopic string, sensors []haSensor) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.announced[k] {
+		return
+	}
+	h.announced[k] = true
+
+	node := "bright_" + haID(k.device)
+	meter := node + "_" + haID(k.id)
+
+	name := "Smart " + kind + " meter"
+	if k.id != kind {
+		name += " " + k.id
+	}
+
+	log.Infof("homeassistant: announcing %s %s/%s", kind, k.device, k.id)
+	tokens := make(map[string]mqtt.Token, len(sensors)+1)
+	for _, s := range sensors {
+		topic := fmt.Sprintf("%s/sensor/%s/%s_%s/config", h.discoveryPrefix, node, haID(k.id), s.field)
+		tokens[topic] = h.publish(topic, haDiscovery{
+			Name:              s.name,
+			UniqueID:          meter + "_" + s.field,
+			StateTopic:        stateTopic,
+			ValueTemplate:     fmt.Sprintf("{{ value_json.%s }}", s.field),
+			DeviceClass:       s.deviceClass,
+			StateClass:        s.stateClass,
+			UnitOfMeasurement: s.unit,
+			Device: haDevice{
+				Identifiers: []string{meter},
+				Name:        name,
+				ViaDevice:   node,
+			},
+		})
+	}
+
+	// The dongle is announced as a device of its own, which the meters are
+	// connected via, by a sensor for the time of its last reading.
+	topic := fmt.Sprintf("%s/sensor/%s/%s_%s_timestamp/config", h.discoveryPrefix, node, haID(k.id), kind)
+	tokens[topic] = h.publish(topic, haDiscovery{
+		Name:          "Last " + kind + " reading",
+		UniqueID:      meter + "_timestamp",
+		StateTopic:    stateTopic,
+		ValueTemplate: "{{ value_json.timestamp }}",
+		DeviceClass:   "timestamp",
+		Device: haDevice{
+			Identifiers:  []string{node},
+			Name:         "Glow " + k.device,
+			Manufacturer: "Hildebrand",
+		},
+	})
+
+	// Announce the meter again with its next reading if any of the configs
+	// didn't make it to the broker.
+	go func() {
+		for topic, token := range tokens {
+			if !wait(topic, token) {
+				h.mu.Lock()
+				delete(h.announced, k)
+				h.mu.Unlock()
+				return
+			}
+		}
+	}()
+}
+
+// publish sends v to topic as retained JSON, returning a token which
+// completes once the broker has it. State is published without waiting for
+// the token, since waiting from the MQTT callback would hold up the client.
+func (h *homeAssistant) publish(topic string, v interface{}) mqtt.Token {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("homeassistant: encoding %s: %v", topic, err)
+		return nil
+	}
+
+	return h.client.Publish(topic, 0, true, payload)
+}
+
+// haID makes s safe to use as an ID in a discovery topic.
+func haID(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return haUnsafe.ReplaceAllString(s, "_")
+}
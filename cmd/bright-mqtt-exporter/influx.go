@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	bright "github.com/rk295/bright-mqtt-exporter/brightmqtt"
+)
+
+// influxTimeout bounds each request to the InfluxDB write API.
+const influxTimeout = 30 * time.Second
+
+var (
+	// Line protocol escaping, measurements may not contain unescaped commas
+	// or spaces and tag keys and values additionally no equals signs.
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+)
+
+// influx is a sink which writes each reading to InfluxDB over the v2 HTTP
+// write API, as a point in the electricity or gas measurement tagged with the
+// device and the meter's MPAN or MPRN.
+//
+// Points are buffered and written in batches by run. A batch which fails is
+// retried with backoff, and while InfluxDB is unreachable the buffer holds up
+// to bufferSize points, after which the oldest are dropped.
+type influx struct {
+	client   *http.Client
+	writeURL string
+	token    string
+
+	batchSize     int
+	bufferSize    int
+	flushInterval time.Duration
+
+	mu     sync.Mutex
+	buffer []string
+
+	// flush is signalled when a full batch is waiting.
+	flush chan struct{}
+}
+
+func newInflux(c influxConfig) *influx {
+	q := url.Values{}
+	q.Set("org", c.Org)
+	q.Set("bucket", c.Bucket)
+	q.Set("precision", "s")
+
+	return &influx{
+		client:        &http.Client{Timeout: influxTimeout},
+		writeURL:      strings.TrimSuffix(c.URL, "/") + "/api/v2/write?" + q.Encode(),
+		token:         c.Token,
+		batchSize:     c.BatchSize,
+		bufferSize:    c.BufferSize,
+		flushInterval: c.FlushInterval,
+		flush:         make(chan struct{}, 1),
+	}
+}
+
+func (i *influx) write(k meterKey, r bright.Reading) {
+	tags := map[string]string{
+		"device":   k.device,
+		"supplier": r.Supplier,
+	}
+	fields := map[string]float64{
+		"import_kwh":       r.Import.Cumulative,
+		"import_day_kwh":   r.Import.Day,
+		"import_week_kwh":  r.Import.Week,
+		"import_month_kwh": r.Import.Month,
+	}
+	if r.Price != nil {
+		fields["unit_rate_gbp_per_kwh"] = r.Price.Unitrate
+		fields["standing_charge_gbp_per_day"] = r.Price.StandingCharge
+	}
+
+	switch r.Kind {
+	case bright.KindElectricity:
+		tags["mpan"] = r.MeterID
+		fields["power_kw"] = r.Power
+		fields["export_kwh"] = r.Export.Cumulative
+	case bright.KindGas:
+		tags["mprn"] = r.MeterID
+		fields["volume_m3"] = r.Volume.Cumulative
+	default:
+		return
+	}
+
+	i.add(influxLine(string(r.Kind), tags, fields, r.Timestamp))
+}
+
+// add buffers line, dropping the oldest buffered line if the buffer is full.
+func (i *influx) add(line string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if len(i.buffer) >= i.bufferSize {
+		log.Warnf("influxdb: buffer of %d points is full, dropping the oldest", i.bufferSize)
+		i.buffer = i.buffer[1:]
+	}
+	i.buffer = append(i.buffer, line)
+
+	if len(i.buffer) >= i.batchSize {
+		select {
+		case i.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run writes the buffered points every flush interval, or as soon as a full
+// batch is waiting. It never returns.
+func (i *influx) run() {
+	ticker := time.NewTicker(i.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-i.flush:
+		}
+		i.drain()
+	}
+}
+
+// drain writes batches until the buffer is empty, backing off between
+// attempts while writes fail.
+func (i *influx) drain() {
+	backoff := minBackoff
+	for {
+		i.mu.Lock()
+		n := len(i.buffer)
+		if n > i.batchSize {
+			n = i.batchSize
+		}
+		batch := append([]string(nil), i.buffer[:n]...)
+		i.buffer = i.buffer[n:]
+		i.mu.Unlock()
+
+		if len(batch) == 0 {
+			return
+		}
+
+		retry, err := i.post(batch)
+		switch {
+		case err != nil && retry:
+			log.Warnf("influxdb: failed to write %d points, retrying in %s: %v", len(batch), backoff, err)
+			i.requeue(batch)
+			time.Sleep(backoff)
+			backoff = nextBackoff(backoff)
+			continue
+		case err != nil:
+			log.Errorf("influxdb: dropping %d points which were rejected: %v", len(batch), err)
+		default:
+			log.Debugf("influxdb: wrote %d points", len(batch))
+		}
+		backoff = minBackoff
+	}
+}
+
+// requeue puts a batch which failed back at the head of the buffer, dropping
+// the oldest points if that overfills it.
+func (i *influx) requeue(batch []string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.buffer = append(batch, i.buffer...)
+	if over := len(i.buffer) - i.bufferSize; over > 0 {
+		log.Warnf("influxdb: buffer of %d points is full, dropping the oldest %d", i.bufferSize, over)
+		i.buffer = i.buffer[over:]
+	}
+}
+
+// post sends batch to the write API, reporting whether a failure is worth
+// retrying. InfluxDB rejects bad points with a 4xx status, which won't
+// succeed however often they are sent.
+func (i *influx) post(batch []string) (bool, error) {
+	body := strings.Join(batch, "\n")
+	req, err := http.NewRequest(http.MethodPost, i.writeURL, bytes.NewBufferString(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if i.token != "" {
+		req.Header.Set("Authorization", "Token "+i.token)
+	}
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, err
+}
+
+// influxLine formats a point as line protocol. Empty tags are left out, as
+// line protocol doesn't allow them, and tags and fields are sorted so the same
+// point always formats the same way.
+func influxLine(measurement string, tags map[string]string, fields map[string]float64, ts time.Time) string {
+	var b strings.Builder
+	b.WriteString(influxMeasurementEscaper.Replace(measurement))
+
+	tagKeys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if v != "" {
+			tagKeys = append(tagKeys, k)
+		}
+	}
+	sort.Strings(tagKeys)
+	for _, k := range tagKeys {
+		fmt.Fprintf(&b, ",%s=%s", influxTagEscaper.Replace(k), influxTagEscaper.Replace(tags[k]))
+	}
+
+	fieldKeys := make([]string, 0, len(fields))
+	for k := range fields {
+		fieldKeys = append(fieldKeys, k)
+	}
+	sort.Strings(fieldKeys)
+	for n, k := range fieldKeys {
+		sep := ","
+		if n == 0 {
+			sep = " "
+		}
+		fmt.Fprintf(&b, "%s%s=%s", sep, influxTagEscaper.Replace(k), strconv.FormatFloat(fields[k], 'f', -1, 64))
+	}
+
+	fmt.Fprintf(&b, " %d", ts.Unix())
+	return b.String()
+}
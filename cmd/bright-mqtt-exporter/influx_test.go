@@ -0,0 +1,198 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeInflux is an InfluxDB write API which answers each request with the
+// next of its statuses, then 204 once they run out.
+type fakeInflux struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	batches  [][]string
+	requests []*http.Request
+}
+
+func newFakeInflux(t *testing.T, statuses ...int) *fakeInflux {
+	f := &fakeInflux{statuses: statuses}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.batches = append(f.batches, strings.Split(string(body), "\n"))
+		f.requests = append(f.requests, r)
+
+		status := http.StatusNoContent
+		if len(f.statuses) > 0 {
+			status, f.statuses = f.statuses[0], f.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeInflux) sink(batchSize, bufferSize int) *influx {
+	return newInflux(influxConfig{
+		URL:           f.URL + "/",
+		Org:           "home",
+		Bucket:        "energy",
+		Token:         "secret",
+		BatchSize:     batchSize,
+		BufferSize:    bufferSize,
+		FlushInterval: time.Minute,
+	})
+}
+
+func (f *fakeInflux) received() [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.batches
+}
+
+func TestInfluxBatching(t *testing.T) {
+	f := newFakeInflux(t)
+	i := f.sink(2, 10)
+
+	i.add("a")
+	if len(i.flush) != 0 {
+		t.Error("flush signalled before a batch was full")
+	}
+	for _, line := range []string{"b", "c", "d", "e"} {
+		i.add(line)
+	}
+	if len(i.flush) != 1 {
+		t.Error("flush not signalled once a batch was full")
+	}
+
+	i.drain()
+
+	want := [][]string{{"a", "b"}, {"c", "d"}, {"e"}}
+	if got := f.received(); !reflect.DeepEqual(got, want) {
+		t.Errorf("batches = %q, want %q", got, want)
+	}
+
+	r := f.requests[0]
+	if r.URL.Path != "/api/v2/write" {
+		t.Errorf("path = %s, want /api/v2/write", r.URL.Path)
+	}
+	if q := r.URL.Query(); q.Get("org") != "home" || q.Get("bucket") != "energy" || q.Get("precision") != "s" {
+		t.Errorf("query = %s, want org, bucket and precision", r.URL.RawQuery)
+	}
+	if auth := r.Header.Get("Authorization"); auth != "Token secret" {
+		t.Errorf("Authorization = %q, want Token secret", auth)
+	}
+}
+
+func TestInfluxRetry(t *testing.T) {
+	for _, status := range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			f := newFakeInflux(t, status)
+			i := f.sink(2, 10)
+			for _, line := range []string{"a", "b", "c"} {
+				i.add(line)
+			}
+
+			i.drain()
+
+			// The failed batch goes back at the head of the buffer, so
+			// is retried before the points behind it.
+			want := [][]string{{"a", "b"}, {"a", "b"}, {"c"}}
+			if got := f.received(); !reflect.DeepEqual(got, want) {
+				t.Errorf("batches = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestInfluxRejected(t *testing.T) {
+	f := newFakeInflux(t, http.StatusBadRequest)
+	i := f.sink(2, 10)
+	for _, line := range []string{"a", "b", "c"} {
+		i.add(line)
+	}
+
+	i.drain()
+
+	want := [][]string{{"a", "b"}, {"c"}}
+	if got := f.received(); !reflect.DeepEqual(got, want) {
+		t.Errorf("batches = %q, want %q", got, want)
+	}
+	if len(i.buffer) != 0 {
+		t.Errorf("buffer = %q, want the rejected batch dropped", i.buffer)
+	}
+}
+
+func TestInfluxBufferFull(t *testing.T) {
+	i := newInflux(influxConfig{BatchSize: 10, BufferSize: 3})
+
+	for _, line := range []string{"a", "b", "c", "d", "e"} {
+		i.add(line)
+	}
+	if want := []string{"c", "d", "e"}; !reflect.DeepEqual(i.buffer, want) {
+		t.Errorf("buffer = %q, want %q", i.buffer, want)
+	}
+
+	// A requeued batch which overfills the buffer loses its oldest points.
+	i.buffer = []string{"c"}
+	i.bufferSize = 2
+	i.requeue([]string{"a", "b"})
+	if want := []string{"b", "c"}; !reflect.DeepEqual(i.buffer, want) {
+		t.Errorf("buffer after requeue = %q, want %q", i.buffer, want)
+	}
+}
+
+func TestInfluxLine(t *testing.T) {
+	ts := time.Date(2022, 8, 25, 6, 16, 59, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		measurement string
+		tags        map[string]string
+		fields      map[string]float64
+		want        string
+	}{
+		{
+			name:        "sorted",
+			measurement: "electricity",
+			tags:        map[string]string{"mpan": "1012400931394", "device": "ABCDEF"},
+			fields:      map[string]float64{"power_kw": 0.481, "import_kwh": 4896.645},
+			want:        "electricity,device=ABCDEF,mpan=1012400931394 import_kwh=4896.645,power_kw=0.481 1661408219",
+		},
+		{
+			name:        "empty tags left out",
+			measurement: "gas",
+			tags:        map[string]string{"device": "ABCDEF", "supplier": ""},
+			fields:      map[string]float64{"import_kwh": 12491.78},
+			want:        "gas,device=ABCDEF import_kwh=12491.78 1661408219",
+		},
+		{
+			name:        "escaped",
+			measurement: "my gas,meter",
+			tags:        map[string]string{"supplier": "British Gas, a=b"},
+			fields:      map[string]float64{"cost gbp": 1e-7},
+			want:        `my\ gas\,meter,supplier=British\ Gas\,\ a\=b cost\ gbp=0.0000001 1661408219`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := influxLine(tt.measurement, tt.tags, tt.fields, ts); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
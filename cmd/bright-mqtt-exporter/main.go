@@ -1,14 +1,13 @@
 package main
 
 import (
-	"crypto/tls"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
-	"strings"
+	"time"
 
-	"github.com/certifi/gocertifi"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -18,250 +17,265 @@ import (
 )
 
 const (
-	electricityTopic = "electricitymeter"
-	gasTopic         = "gasmeter"
+	electricityMetricName = string(bright.KindElectricity)
+	gasMetricName         = string(bright.KindGas)
+
+	// Message formats, either the one the dongle sends to a local broker,
+	// the verbose one sent to Glow's own broker or auto detected per message.
+	formatAuto  = "auto"
+	formatLocal = "local"
+	formatCloud = "cloud"
+)
 
-	electricityMetricName = "electricity"
-	gasMetricName         = "gas"
+// Data holds the most recent message received for each meter, keyed by the
+// Glow device which sent it and the meter's identity (MPAN for electricity,
+// MPRN for gas) so several dongles and meters can share a broker without
+// overwriting each other.
+type Data struct {
+	readings *store
+	metrics  *metricSet
 
-	mqttHostEnv     = "MQTT_HOST"
-	mqttUserEnv     = "MQTT_USER"
-	mqttPassEnv     = "MQTT_PASS"
-	mqttTopicEnv    = "MQTT_TOPIC"
-	exporterPortEnv = "PORT"
+	// maxAge is how old a meter's last reading may be before its series are
+	// dropped from Collect. Zero disables the check.
+	maxAge time.Duration
 
-	mqttDefaultHost = "192.168.0.50:1883"
-	mqttDefaultUser = "admin"
+	// format is the message format to decode, one of formatAuto,
+	// formatLocal or formatCloud.
+	format string
 
-	exporterDefaultPort = "9999"
-)
+	// gas configures computing gas energy from volume.
+	gas gasConfig
 
-type Meters map[string]float64
+	// sinks are sent every reading as well as the store.
+	sinks []sink
 
-type Data struct {
-	Usage          Meters
-	UnitRate       Meters
-	StandingCharge Meters
+	// pipeline records metrics about every message handled.
+	pipeline *pipeline
+
+	// recorder, if set, records every message received.
+	recorder *recorder
 }
 
-type config struct {
-	mqttHost     string
-	mqttUser     string
-	mqttPass     string
-	mqttTopic    string
-	exporterPort string
+// meterKey identifies a single meter behind a single Glow dongle.
+type meterKey struct {
+	device string
+	id     string
 }
 
 var (
 	currentValues Data
-
-	electricityUsageDetails = prometheus.NewDesc(
-		prometheus.BuildFQName("uk_riviera", "monitoring", "electricity"),
-		"electricity power usage readings from the smart meter in kWh",
-		[]string{}, nil,
-	)
-
-	gasUsageDetails = prometheus.NewDesc(
-		prometheus.BuildFQName("uk_riviera", "monitoring", "gas"),
-		"gas usage readings from the smart meter in kWh",
-		[]string{}, nil,
-	)
-
-	rateDetails = prometheus.NewDesc(
-		prometheus.BuildFQName("uk_riviera", "monitoring", "price_per_unit"),
-		"price per power (kWh) unit",
-		[]string{"source"}, nil,
-	)
-
-	standingChartDetails = prometheus.NewDesc(
-		prometheus.BuildFQName("uk_riviera", "monitoring", "standing_charge"),
-		"price per power (kWh) unit",
-		[]string{"source"}, nil,
-	)
 )
 
 func init() {
-	log.SetOutput(os.Stdout)
+	// Logs go to stderr, leaving stdout for output such as --print-config
+	// and replay's metrics.
+	log.SetOutput(os.Stderr)
 	log.SetLevel(log.DebugLevel)
 
-	log.Debug("starting...")
-	currentValues.Usage = make(map[string]float64)
-	currentValues.UnitRate = make(map[string]float64)
-	currentValues.StandingCharge = make(map[string]float64)
+	currentValues.readings = newStore()
 }
 
 func main() {
 
-	config, err := newConfig()
-	if err != nil {
-		log.Error(err)
-		os.Exit(1)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case replayCommand:
+			os.Exit(replay(os.Args[0]+" "+replayCommand, os.Args[2:]))
+		case simulateCommand:
+			os.Exit(simulate(os.Args[0]+" "+simulateCommand, os.Args[2:]))
+		}
 	}
-	var qos byte
 
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(config.mqttHost)
-	opts.SetAutoReconnect(true)
-	opts.SetConnectRetry(true)
-	opts.SetPassword(config.mqttPass)
-	opts.SetUsername(config.mqttUser)
-
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
-	}
-	log.Debugf("subscribing to topic %s", config.mqttTopic)
-	_ = client.Subscribe(config.mqttTopic, qos, currentValues.newMessage)
+	log.Debug("starting...")
 
-	certPool, err := gocertifi.CACerts()
-	if err != nil {
-		log.Fatalln("failed to initialize root CA pool:", err)
-	}
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{
-		RootCAs: certPool,
+	config, err := newConfig(os.Args[0], os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
 	}
-
-	prometheus.MustRegister(currentValues)
-
-	http.Handle("/metrics", promhttp.Handler())
-	log.Printf("starting metrics server on port %s", config.exporterPort)
-
-	if err := http.ListenAndServe(fmt.Sprintf(":%s", config.exporterPort), nil); err != nil {
-		log.Fatal(err)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
 	}
-}
-
-func (d Data) newMessage(c mqtt.Client, m mqtt.Message) {
 
-	switch {
-	case strings.HasSuffix(m.Topic(), electricityTopic):
-		t := &bright.ElectricitysMsg{}
-		if err := json.Unmarshal(m.Payload(), &t); err != nil {
-			log.Error(err)
-			return
+	if config.printConfig {
+		if err := config.print(os.Stdout); err != nil {
+			log.Fatal(err)
 		}
-
-		err := d.updateElectricity(t.Electricitymeter, electricityMetricName)
-		if err != nil {
+		if err := config.validate(); err != nil {
 			log.Error(err)
+			os.Exit(1)
 		}
+		return
+	}
 
-	case strings.HasSuffix(m.Topic(), gasTopic):
-		t := &bright.GasMsg{}
-		if err := json.Unmarshal(m.Payload(), &t); err != nil {
-			log.Error(err)
-			return
-		}
+	level, _ := log.ParseLevel(config.LogLevel)
+	log.SetLevel(level)
+	log.Debugf("mqtt config: host=%s user=%s topic=%s qos=%d client-id=%s message-format=%s",
+		config.MQTT.Host, config.MQTT.User, config.MQTT.Topic, config.MQTT.QoS, config.MQTT.ClientID, config.MQTT.MessageFormat)
+	log.Debugf("metrics config: namespace=%s subsystem=%s naming=%s", config.Metrics.Namespace, config.Metrics.Subsystem, config.Metrics.Naming)
+	log.Infof("bright-mqtt-exporter version %s, commit %s", version, commit)
+	log.Debugf("exporter config: port=%s reading-max-age=%s ready-max-age=%s", config.Exporter.Port, config.Exporter.ReadingMaxAge, config.Exporter.ReadyMaxAge)
 
-		err := d.updateGate(t.Gasmeter, gasMetricName)
+	currentValues.maxAge = config.Exporter.ReadingMaxAge
+	currentValues.format = config.MQTT.MessageFormat
+	currentValues.gas = config.Gas
+
+	if config.Record.File != "" {
+		currentValues.recorder, err = newRecorder(config.Record)
 		if err != nil {
 			log.Error(err)
+			os.Exit(1)
 		}
-	default:
-		return
+		log.Infof("recording messages to %s", config.Record.File)
 	}
 
-}
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(config.MQTT.Host)
+	opts.SetClientID(config.MQTT.ClientID)
+	opts.SetPassword(config.MQTT.Pass)
+	opts.SetUsername(config.MQTT.User)
 
-func (d Data) updateGate(m bright.GasMeter, kind string) error {
+	tlsConfig, err := config.MQTT.TLS.build()
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	opts.SetTLSConfig(tlsConfig)
 
-	log.Debugf("mqtt: updating %s with %v", gasMetricName, m.Energy.Import.Cumulative)
-	d.Usage[kind] = float64(m.Energy.Import.Cumulative)
+	currentValues.metrics = newMetricSet(config.Metrics.Namespace, config.Metrics.Subsystem, config.Metrics.Naming)
+	currentValues.pipeline = newPipeline(config.Metrics.Namespace, config.Metrics.Subsystem)
 
-	d.UnitRate[kind] = m.Energy.Import.Price.Unitrate             // Unit rate update
-	d.StandingCharge[kind] = m.Energy.Import.Price.StandingCharge // Standing charge update
+	// The handler looks up currentValues when called, rather than being bound
+	// to it now, as sinks publishing through the broker's client are only
+	// added once the broker exists.
+	handler := func(c mqtt.Client, m mqtt.Message) { currentValues.newMessage(c, m) }
+	broker := newBroker(opts, config.MQTT.Topic, byte(config.MQTT.QoS), handler,
+		config.Metrics.Namespace, config.Metrics.Subsystem)
 
-	return nil
-}
+	if config.HomeAssistant.Enabled {
+		currentValues.sinks = append(currentValues.sinks, newHomeAssistant(broker.client, config.HomeAssistant))
+	}
+	if config.Republish.Enabled {
+		currentValues.sinks = append(currentValues.sinks, newRepublisher(broker.client, config.Republish))
+	}
+	if config.InfluxDB.URL != "" {
+		influx := newInflux(config.InfluxDB)
+		currentValues.sinks = append(currentValues.sinks, influx)
+		go influx.run()
+	}
 
-func (d Data) updateElectricity(m bright.ElectricityMeter, kind string) error {
+	prometheus.MustRegister(currentValues)
+	prometheus.MustRegister(broker)
+	prometheus.MustRegister(currentValues.pipeline)
 
-	log.Debugf("mqtt: updating %s with %v", electricityMetricName, m.Power.Value)
-	d.Usage[kind] = float64(m.Power.Value)
+	// Connect in the background so metrics are served, and show the broker
+	// is down, even when it can't be reached.
+	go broker.connect()
 
-	d.UnitRate[kind] = m.Energy.Import.Price.Unitrate             // Unit rate update
-	d.StandingCharge[kind] = m.Energy.Import.Price.StandingCharge // Standing charge update
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", healthzHandler)
+	http.Handle("/readyz", readyzHandler(broker, currentValues.readings, config.Exporter.ReadyMaxAge))
+	log.Printf("starting metrics server on port %s", config.Exporter.Port)
 
-	return nil
+	if err := http.ListenAndServe(fmt.Sprintf(":%s", config.Exporter.Port), nil); err != nil {
+		log.Fatal(err)
+	}
 }
 
-func (d Data) Describe(ch chan<- *prometheus.Desc) {
-	ch <- electricityUsageDetails
+func (d Data) newMessage(c mqtt.Client, m mqtt.Message) {
+	received := time.Now()
+	if d.recorder != nil {
+		d.recorder.record(m.Topic(), m.Payload(), received)
+	}
+	d.handle(m.Topic(), m.Payload(), received)
 }
 
-func (d Data) Collect(ch chan<- prometheus.Metric) {
-	ch <- prometheus.MustNewConstMetric(
-		electricityUsageDetails,
-		prometheus.GaugeValue,
-		d.Usage[electricityMetricName],
-		[]string{}...,
-	)
-
-	ch <- prometheus.MustNewConstMetric(
-		gasUsageDetails,
-		prometheus.CounterValue,
-		d.Usage[gasMetricName],
-		[]string{}...,
-	)
-
-	for r, d := range d.UnitRate {
-		ch <- prometheus.MustNewConstMetric(
-			rateDetails,
-			prometheus.GaugeValue,
-			d,
-			[]string{r}...,
-		)
-	}
+// handle decodes a message received on topic at received and stores its
+// readings. Both live messages and replayed recordings come through here, so
+// a recording reproduces exactly what happened to the original messages.
+func (d Data) handle(topic string, payload []byte, received time.Time) {
+	d.pipeline.received(topic, received)
+	defer d.pipeline.processed(time.Now())
 
-	for r, d := range d.StandingCharge {
-		ch <- prometheus.MustNewConstMetric(
-			standingChartDetails,
-			prometheus.GaugeValue,
-			d,
-			[]string{r}...,
-		)
+	readings, err := d.decode(topic, payload)
+	if err != nil {
+		d.decodeFailed(topic, err)
 	}
 
+	for _, r := range readings {
+		for _, field := range r.UnknownFields {
+			d.pipeline.unknownField(string(r.Kind), field)
+			log.Debugf("mqtt: ignoring unknown field %s in %s message on %s", field, r.Kind, topic)
+		}
+		d.update(r, received)
+	}
 }
 
-func newConfig() (*config, error) {
-	c := &config{}
-
-	mqttHost := os.Getenv(mqttHostEnv)
-	if mqttHost == "" {
-		log.Debugf("%s not set, using default host of %s", mqttHostEnv, mqttDefaultHost)
-		mqttHost = mqttDefaultHost
+// decode decodes a message in the configured format.
+func (d Data) decode(topic string, payload []byte) ([]bright.Reading, error) {
+	switch d.format {
+	case formatLocal:
+		r, err := bright.Decode(topic, payload)
+		if err != nil {
+			return nil, err
+		}
+		return []bright.Reading{r}, nil
+	case formatCloud:
+		return bright.DecodeCloud(topic, payload)
+	default:
+		return bright.DecodeAll(topic, payload)
 	}
-	c.mqttHost = mqttHost
+}
 
-	mqttUser := os.Getenv(mqttUserEnv)
-	if mqttUser == "" {
-		log.Debugf("%s not set, using default user of %s", mqttUserEnv, mqttDefaultUser)
-		mqttUser = mqttDefaultUser
+// decodeFailed counts and logs a message which couldn't be decoded. Messages
+// on topics we don't understand aren't errors, there may be other devices
+// publishing under the topic we subscribe to.
+func (d Data) decodeFailed(topic string, err error) {
+	switch {
+	case errors.Is(err, bright.ErrUnknownTopic):
+		d.pipeline.unknown()
+		log.Debugf("mqtt: ignoring message on unknown topic %s", topic)
+		return
+	case errors.Is(err, bright.ErrMalformedJSON):
+		d.pipeline.decodeError(decodeErrorJSON)
+	case errors.Is(err, bright.ErrMissingField):
+		d.pipeline.decodeError(decodeErrorMissing)
+	case errors.Is(err, bright.ErrUnknownUnit):
+		d.pipeline.decodeError(decodeErrorUnits)
+	case errors.Is(err, bright.ErrOutOfRange):
+		d.pipeline.decodeError(decodeErrorRange)
+	case errors.Is(err, bright.ErrCloudFormat):
+		d.pipeline.decodeError(decodeErrorCloud)
 	}
-	c.mqttUser = mqttUser
+	log.Errorf("decoding message on %s: %v", topic, err)
+}
 
-	mqttPass := os.Getenv(mqttPassEnv)
-	if mqttPass == "" {
-		return c, fmt.Errorf("the %s variable must be set to the connection password", mqttPassEnv)
+// update stores a reading received at received, which stands in for the
+// reading's timestamp if it has none, and passes it on to the sinks.
+func (d Data) update(r bright.Reading, received time.Time) {
+	if r.Kind == bright.KindState {
+		log.Debugf("mqtt: updating state of %s", r.Device)
+		d.readings.setState(r.Device, *r.State)
+		return
 	}
-	c.mqttPass = mqttPass
 
-	mqttTopic := os.Getenv(mqttTopicEnv)
-	if mqttTopic == "" {
-		return c, fmt.Errorf("the %s variable must be set to the topic", mqttTopicEnv)
+	if r.Timestamp.IsZero() {
+		r.Timestamp = received
 	}
-	c.mqttTopic = mqttTopic
 
-	exporterPort := os.Getenv(exporterPortEnv)
-	if exporterPort == "" {
-		log.Debugf("%s not set, using default port of %s", exporterPortEnv, exporterDefaultPort)
-		exporterPort = exporterDefaultPort
+	key := meterKey{device: r.Device, id: meterID(string(r.Kind), r.MeterID)}
+	log.Debugf("mqtt: updating %s %s/%s with %v", r.Kind, key.device, key.id, r.Import.Cumulative)
+	d.readings.set(key, r)
+	for _, s := range d.sinks {
+		s.write(key, r)
 	}
-	c.exporterPort = exporterPort
-
-	log.Debugf("mqtt config: host=%s user=%s topic=%s exporter-port=%s", mqttHost, mqttUser, mqttTopic, exporterPort)
-
-	return c, nil
+}
 
+// meterID returns the identity used to key a meter's state, falling back to
+// the kind of meter for firmware which doesn't report an MPAN or MPRN.
+func meterID(kind, id string) string {
+	if id == "" {
+		return kind
+	}
+	return id
 }
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Naming schemes for the exporter's metrics. Conventional names follow
+	// the Prometheus conventions, with unit suffixes. Legacy names are the
+	// ones the exporter used before it had a choice, both emits every series
+	// under both names to allow dashboards to be migrated.
+	namingConventional = "conventional"
+	namingLegacy       = "legacy"
+	namingBoth         = "both"
+)
+
+// metric identifies one of the metrics the collector emits, independent of
+// the naming scheme.
+type metric int
+
+const (
+	electricityPowerMetric metric = iota
+	gasUsageMetric
+	unitRateMetric
+	standingChargeMetric
+	meterInfoMetric
+	energyImportTotalMetric
+	energyImportMetric
+	energyExportTotalMetric
+	energyExportMetric
+	energyNetImportMetric
+	costTotalMetric
+	costTodayMetric
+	gasVolumeTotalMetric
+	gasVolumeMetric
+	gasEnergyComputedTotalMetric
+	gasEnergyComputedMetric
+	lastReadingMetric
+	meterUpMetric
+	dongleInfoMetric
+	dongleUptimeMetric
+	dongleRssiMetric
+	hanStatusMetric
+)
+
+// metricDef describes a metric under each naming scheme. An empty
+// conventional name means the metric is only emitted with legacy naming,
+// because another metric already covers it. legacyLabels, if set, replaces
+// labels under the legacy name, which must take the same values in the same
+// order.
+type metricDef struct {
+	legacy       string
+	conventional string
+	help         string
+	labels       []string
+	legacyLabels []string
+}
+
+var metricDefs = map[metric]metricDef{
+	electricityPowerMetric: {
+		legacy:       "electricity",
+		conventional: "electricity_power_kilowatts",
+		help:         "instantaneous electricity power demand from the smart meter in kW",
+		labels:       []string{"device", "meter_id"},
+	},
+	gasUsageMetric: {
+		legacy: "gas",
+		help:   "cumulative gas energy imported as reported by the smart meter in kWh",
+		labels: []string{"device", "meter_id"},
+	},
+	unitRateMetric: {
+		legacy:       "price_per_unit",
+		conventional: "unit_rate_gbp_per_kwh",
+		help:         "price per kWh unit of energy in GBP",
+		labels:       []string{"device", "meter", "meter_id"},
+		legacyLabels: []string{"device", "source", "meter_id"},
+	},
+	standingChargeMetric: {
+		legacy:       "standing_charge",
+		conventional: "standing_charge_gbp_per_day",
+		help:         "daily standing charge in GBP",
+		labels:       []string{"device", "meter", "meter_id"},
+		legacyLabels: []string{"device", "source", "meter_id"},
+	},
+	meterInfoMetric: {
+		legacy:       "meter_info",
+		conventional: "meter_info",
+		help:         "identity of each smart meter, join on meter_id for the mpan, mprn and supplier",
+		labels:       []string{"device", "meter", "meter_id", "mpan", "mprn", "supplier"},
+	},
+	energyImportTotalMetric: {
+		legacy:       "energy_import_total",
+		conventional: "energy_import_kwh_total",
+		help:         "cumulative energy imported as reported by the smart meter in kWh",
+		labels:       []string{"device", "meter", "meter_id"},
+	},
+	energyImportMetric: {
+		legacy:       "energy_import",
+		conventional: "energy_import_kwh",
+		help:         "energy imported so far in the current day, week or month in kWh",
+		labels:       []string{"device", "meter", "meter_id", "period"},
+	},
+	energyExportTotalMetric: {
+		legacy:       "energy_export_total",
+		conventional: "energy_export_kwh_total",
+		help:         "cumulative energy exported (e.g. from solar or a battery) as reported by the smart meter in kWh",
+		labels:       []string{"device", "meter", "meter_id"},
+	},
+	energyExportMetric: {
+		legacy:       "energy_export",
+		conventional: "energy_export_kwh",
+		help:         "energy exported so far in the current day, week or month in kWh",
+		labels:       []string{"device", "meter", "meter_id", "period"},
+	},
+	energyNetImportMetric: {
+		legacy:       "energy_net_import",
+		conventional: "energy_net_import_kwh",
+		help:         "cumulative energy imported less cumulative energy exported in kWh",
+		labels:       []string{"device", "meter", "meter_id"},
+	},
+	costTotalMetric: {
+		legacy:       "cost_pounds_total",
+		conventional: "cost_gbp_total",
+		help:         "cost of the energy used since the exporter started, at the unit rate in force when it was used",
+		labels:       []string{"device", "meter", "meter_id"},
+	},
+	costTodayMetric: {
+		legacy:       "cost_today_pounds",
+		conventional: "cost_today_gbp",
+		help:         "cost of the energy used today plus the standing charge pro-rated to the last reading",
+		labels:       []string{"device", "meter", "meter_id"},
+	},
+	gasVolumeTotalMetric: {
+		legacy:       "gas_volume_total",
+		conventional: "gas_volume_m3_total",
+		help:         "cumulative gas volume as reported by the smart meter in m3",
+		labels:       []string{"device", "meter_id"},
+	},
+	gasVolumeMetric: {
+		legacy:       "gas_volume",
+		conventional: "gas_volume_m3",
+		help:         "gas volume used so far in the current day, week or month in m3",
+		labels:       []string{"device", "meter_id", "period"},
+	},
+	gasEnergyComputedTotalMetric: {
+		legacy:       "gas_energy_computed_kwh_total",
+		conventional: "gas_energy_computed_kwh_total",
+		help:         "cumulative gas energy in kWh computed from the metered volume and configured calorific value",
+		labels:       []string{"device", "meter_id"},
+	},
+	gasEnergyComputedMetric: {
+		legacy:       "gas_energy_computed_kwh",
+		conventional: "gas_energy_computed_kwh",
+		help:         "gas energy in kWh used so far in the current day, week or month, computed from the metered volume",
+		labels:       []string{"device", "meter_id", "period"},
+	},
+	lastReadingMetric: {
+		legacy:       "last_reading_timestamp_seconds",
+		conventional: "last_reading_timestamp_seconds",
+		help:         "time of the last reading from each meter, as reported by the meter",
+		labels:       []string{"device", "meter", "meter_id"},
+	},
+	meterUpMetric: {
+		legacy:       "meter_up",
+		conventional: "meter_up",
+		help:         "whether the last reading from each meter is within the configured max age",
+		labels:       []string{"device", "meter", "meter_id"},
+	},
+	dongleInfoMetric: {
+		legacy:       "dongle_info",
+		conventional: "dongle_info",
+		help:         "firmware and hardware versions reported by each Glow dongle",
+		labels:       []string{"device", "software", "hardware", "zigbee", "smets_version"},
+	},
+	dongleUptimeMetric: {
+		legacy:       "dongle_uptime_seconds",
+		conventional: "dongle_uptime_seconds",
+		help:         "time since each Glow dongle last restarted",
+		labels:       []string{"device"},
+	},
+	dongleRssiMetric: {
+		legacy:       "dongle_rssi_dbm",
+		conventional: "dongle_rssi_dbm",
+		help:         "signal strength of each Glow dongle's wifi and smart meter (han) links",
+		labels:       []string{"device", "interface"},
+	},
+	hanStatusMetric: {
+		legacy:       "han_status",
+		conventional: "han_status",
+		help:         "status of each Glow dongle's link to the smart meter home area network, always 1",
+		labels:       []string{"device", "status"},
+	},
+}
+
+// metricSet holds the descriptors for every metric under the configured
+// naming scheme. With namingBoth a metric has two descriptors, unless both
+// its names are the same.
+type metricSet struct {
+	descs map[metric][]*prometheus.Desc
+}
+
+func newMetricSet(namespace, subsystem, naming string) *metricSet {
+	s := &metricSet{descs: make(map[metric][]*prometheus.Desc, len(metricDefs))}
+
+	for m, def := range metricDefs {
+		var names []string
+		switch naming {
+		case namingConventional:
+			if def.conventional != "" {
+				names = append(names, def.conventional)
+			}
+		case namingLegacy:
+			names = append(names, def.legacy)
+		case namingBoth:
+			if def.conventional != "" {
+				names = append(names, def.conventional)
+			}
+			if def.legacy != def.conventional {
+				names = append(names, def.legacy)
+			}
+		}
+
+		for _, name := range names {
+			labels := def.labels
+			if name == def.legacy && def.legacyLabels != nil {
+				labels = def.legacyLabels
+			}
+			s.descs[m] = append(s.descs[m], prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, subsystem, name),
+				def.help,
+				labels, nil,
+			))
+		}
+	}
+
+	return s
+}
+
+func (s *metricSet) describe(ch chan<- *prometheus.Desc) {
+	for _, descs := range s.descs {
+		for _, desc := range descs {
+			ch <- desc
+		}
+	}
+}
+
+// send sends a sample of m under each of its names.
+func (s *metricSet) send(ch chan<- prometheus.Metric, m metric, t prometheus.ValueType, v float64, labels ...string) {
+	for _, desc := range s.descs[m] {
+		ch <- prometheus.MustNewConstMetric(desc, t, v, labels...)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Bounds of the exponential backoff between attempts to connect or
+	// subscribe.
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+
+	// publishTimeout is how long to wait for the broker to accept a publish
+	// before logging it as failed.
+	publishTimeout = 30 * time.Second
+)
+
+// broker manages the connection to the MQTT broker. The initial connection is
+// retried with backoff until it succeeds, after which paho's auto reconnect
+// takes over, and the subscription is remade every time the connection is.
+type broker struct {
+	client  mqtt.Client
+	topic   string
+	qos     byte
+	handler mqtt.MessageHandler
+
+	// connected and subscribed are 1 while the client is connected to the
+	// broker and subscribed to the topic, and 0 otherwise.
+	connected  int32
+	subscribed int32
+
+	connectedGauge  prometheus.Gauge
+	reconnectsTotal prometheus.Counter
+}
+
+// newBroker returns a broker for opts which will subscribe to topic once
+// connected, sending messages to handler. Any connection handlers already set
+// in opts are replaced. Its own metrics are named under namespace and
+// subsystem.
+func newBroker(opts *mqtt.ClientOptions, topic string, qos byte, handler mqtt.MessageHandler, namespace, subsystem string) *broker {
+	b := &broker{
+		topic:   topic,
+		qos:     qos,
+		handler: handler,
+
+		connectedGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "mqtt_connected",
+			Help:      "whether the exporter is currently connected to the MQTT broker",
+		}),
+		reconnectsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "mqtt_reconnects_total",
+			Help:      "number of times the exporter has tried to reconnect to the MQTT broker after losing the connection",
+		}),
+	}
+
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(false)
+	opts.SetMaxReconnectInterval(maxBackoff)
+	opts.SetOnConnectHandler(b.onConnect)
+	opts.SetConnectionLostHandler(b.onConnectionLost)
+	opts.SetReconnectingHandler(b.onReconnecting)
+
+	b.client = mqtt.NewClient(opts)
+
+	return b
+}
+
+// Describe and Collect make the broker's own metrics available through a
+// single registration.
+func (b *broker) Describe(ch chan<- *prometheus.Desc) {
+	b.connectedGauge.Describe(ch)
+	b.reconnectsTotal.Describe(ch)
+}
+
+func (b *broker) Collect(ch chan<- prometheus.Metric) {
+	b.connectedGauge.Collect(ch)
+	b.reconnectsTotal.Collect(ch)
+}
+
+// connect blocks until the first connection to the broker succeeds, retrying
+// with backoff. From then on paho reconnects by itself.
+func (b *broker) connect() {
+	backoff := minBackoff
+	for {
+		token := b.client.Connect()
+		token.Wait()
+		err := token.Error()
+		if err == nil {
+			return
+		}
+		log.Warnf("mqtt: failed to connect, retrying in %s: %v", backoff, err)
+
+		time.Sleep(backoff)
+		backoff = nextBackoff(backoff)
+	}
+}
+
+// isConnected reports whether the client is connected to the broker.
+func (b *broker) isConnected() bool {
+	return atomic.LoadInt32(&b.connected) == 1
+}
+
+// isSubscribed reports whether the client is subscribed to the topic.
+func (b *broker) isSubscribed() bool {
+	return atomic.LoadInt32(&b.subscribed) == 1
+}
+
+func (b *broker) onConnect(c mqtt.Client) {
+	log.Info("mqtt: connected")
+	atomic.StoreInt32(&b.connected, 1)
+	b.connectedGauge.Set(1)
+
+	// paho calls us from its own goroutine, but waiting on the subscription
+	// here would hold up its connection handling.
+	go b.subscribe(c)
+}
+
+// subscribe subscribes to the topic, retrying with backoff until it succeeds
+// or the connection is lost, at which point onConnect will try again.
+func (b *broker) subscribe(c mqtt.Client) {
+	backoff := minBackoff
+	for c.IsConnectionOpen() {
+		log.Debugf("mqtt: subscribing to topic %s", b.topic)
+		token := c.Subscribe(b.topic, b.qos, b.handler)
+		token.Wait()
+		err := token.Error()
+		if err == nil {
+			atomic.StoreInt32(&b.subscribed, 1)
+			log.Infof("mqtt: subscribed to topic %s", b.topic)
+			return
+		}
+		log.Warnf("mqtt: failed to subscribe to %s, retrying in %s: %v", b.topic, backoff, err)
+
+		time.Sleep(backoff)
+		backoff = nextBackoff(backoff)
+	}
+}
+
+func (b *broker) onConnectionLost(_ mqtt.Client, err error) {
+	log.Warnf("mqtt: connection lost: %v", err)
+	atomic.StoreInt32(&b.connected, 0)
+	atomic.StoreInt32(&b.subscribed, 0)
+	b.connectedGauge.Set(0)
+}
+
+func (b *broker) onReconnecting(_ mqtt.Client, _ *mqtt.ClientOptions) {
+	log.Info("mqtt: reconnecting")
+	b.reconnectsTotal.Inc()
+}
+
+func nextBackoff(d time.Duration) time.Duration {
+	d *= 2
+	if d > maxBackoff {
+		return maxBackoff
+	}
+	return d
+}
+
+// wait waits for token to complete, logging why if the publish to topic
+// failed.
+func wait(topic string, token mqtt.Token) bool {
+	if token == nil {
+		return false
+	}
+	if !token.WaitTimeout(publishTimeout) {
+		log.Warnf("mqtt: timed out publishing to %s", topic)
+		return false
+	}
+	if err := token.Error(); err != nil {
+		log.Warnf("mqtt: publishing to %s: %v", topic, err)
+		return false
+	}
+	return true
+}
+
+// topicLevelReplacer replaces the characters which would split a string
+// across topic levels, or act as wildcards.
+var topicLevelReplacer = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+// topicLevel makes s safe to use as a single level of a topic.
+func topicLevel(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return topicLevelReplacer.Replace(s)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons a message failed to decode, the values of the reason label on
+// decode_errors_total.
+const (
+	decodeErrorJSON    = "malformed_json"
+	decodeErrorMissing = "missing_field"
+	decodeErrorCloud   = "cloud_format"
+	decodeErrorUnits   = "unknown_unit"
+	decodeErrorRange   = "out_of_range"
+)
+
+const (
+	// maxUnknownFields caps the distinct fields unknown_fields_total counts
+	// by name. Field names come from the payloads, which anyone able to
+	// publish on the topic controls, so past the cap fields are counted as
+	// unknownFieldOther rather than each adding a series.
+	maxUnknownFields  = 100
+	unknownFieldOther = "other"
+
+	// maxTopics likewise caps the distinct topics messages_received_total
+	// and last_message_timestamp_seconds are labelled with, as a wildcard
+	// subscription accepts any topic.
+	maxTopics  = 100
+	topicOther = "other"
+)
+
+var (
+	// version and commit are set at build time with
+	// -ldflags "-X main.version=... -X main.commit=...".
+	version = "dev"
+	commit  = "unknown"
+)
+
+// pipeline holds the exporter's metrics about itself, covering every message
+// from when it's received until it's stored, so the exporter can be alerted on
+// when messages stop arriving or can't be decoded.
+type pipeline struct {
+	messagesReceived    *prometheus.CounterVec
+	decodeErrors        *prometheus.CounterVec
+	unknownTopic        prometheus.Counter
+	unknownFields       *prometheus.CounterVec
+	lastMessage         *prometheus.GaugeVec
+	processingDurations prometheus.Histogram
+	buildInfo           prometheus.Gauge
+
+	// unknownFieldsSeen is the fields counted by name so far, keyed by
+	// kind and field, and topicsSeen the topics.
+	mu                sync.Mutex
+	unknownFieldsSeen map[string]bool
+	topicsSeen        map[string]bool
+}
+
+func newPipeline(namespace, subsystem string) *pipeline {
+	p := &pipeline{
+		messagesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "messages_received_total",
+			Help:      "number of MQTT messages received on each topic, with any past the first 100 counted as other",
+		}, []string{"topic"}),
+		decodeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "decode_errors_total",
+			Help:      "number of MQTT messages which couldn't be decoded, by reason",
+		}, []string{"reason"}),
+		unknownTopic: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "unknown_topic_messages_total",
+			Help:      "number of MQTT messages received on a topic the exporter doesn't understand",
+		}),
+		unknownFields: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "unknown_fields_total",
+			Help:      "number of times each field the exporter doesn't know has been received, e.g. one added by newer firmware, with any past the first 100 counted as other",
+		}, []string{"kind", "field"}),
+		lastMessage: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "last_message_timestamp_seconds",
+			Help:      "time the last MQTT message was received on each topic, with any past the first 100 counted as other",
+		}, []string{"topic"}),
+		processingDurations: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "message_processing_seconds",
+			Help:      "time taken to decode and store each MQTT message",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+		}),
+		buildInfo: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "build_info",
+			Help:      "version of the exporter, always 1",
+			ConstLabels: prometheus.Labels{
+				"version":   version,
+				"commit":    commit,
+				"goversion": runtime.Version(),
+			},
+		}),
+		unknownFieldsSeen: make(map[string]bool),
+		topicsSeen:        make(map[string]bool),
+	}
+
+	// The reasons are known up front, so start them at zero rather than
+	// having them appear with the first error.
+	for _, reason := range []string{decodeErrorJSON, decodeErrorMissing, decodeErrorCloud, decodeErrorUnits, decodeErrorRange} {
+		p.decodeErrors.WithLabelValues(reason)
+	}
+	p.buildInfo.Set(1)
+
+	return p
+}
+
+// Describe and Collect make the pipeline's metrics available through a single
+// registration.
+func (p *pipeline) Describe(ch chan<- *prometheus.Desc) {
+	p.messagesReceived.Describe(ch)
+	p.decodeErrors.Describe(ch)
+	p.unknownTopic.Describe(ch)
+	p.unknownFields.Describe(ch)
+	p.lastMessage.Describe(ch)
+	p.processingDurations.Describe(ch)
+	p.buildInfo.Describe(ch)
+}
+
+func (p *pipeline) Collect(ch chan<- prometheus.Metric) {
+	p.messagesReceived.Collect(ch)
+	p.decodeErrors.Collect(ch)
+	p.unknownTopic.Collect(ch)
+	p.unknownFields.Collect(ch)
+	p.lastMessage.Collect(ch)
+	p.processingDurations.Collect(ch)
+	p.buildInfo.Collect(ch)
+}
+
+// received records a message arriving on topic at t.
+func (p *pipeline) received(topic string, t time.Time) {
+	p.mu.Lock()
+	if !admit(p.topicsSeen, topic, maxTopics) {
+		topic = topicOther
+	}
+	p.mu.Unlock()
+
+	p.messagesReceived.WithLabelValues(topic).Inc()
+	p.lastMessage.WithLabelValues(topic).Set(float64(t.UnixNano()) / 1e9)
+}
+
+// processed records a message received at t having been handled.
+func (p *pipeline) processed(t time.Time) {
+	p.processingDurations.Observe(time.Since(t).Seconds())
+}
+
+func (p *pipeline) decodeError(reason string) {
+	p.decodeErrors.WithLabelValues(reason).Inc()
+}
+
+func (p *pipeline) unknown() {
+	p.unknownTopic.Inc()
+}
+
+// unknownField records a field the decoder doesn't know in a message of kind.
+func (p *pipeline) unknownField(kind, field string) {
+	// Kinds never contain a dot, so this can't collide.
+	key := kind + "." + field
+
+	p.mu.Lock()
+	if !admit(p.unknownFieldsSeen, key, maxUnknownFields) {
+		field = unknownFieldOther
+	}
+	p.mu.Unlock()
+
+	p.unknownFields.WithLabelValues(kind, field).Inc()
+}
+
+// admit reports whether key may be used as a label value, adding it to seen
+// if there's room for it. Once seen holds limit keys, only those are admitted.
+func admit(seen map[string]bool, key string, limit int) bool {
+	if seen[key] {
+		return true
+	}
+	if len(seen) >= limit {
+		return false
+	}
+	seen[key] = true
+	return true
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestUnknownFieldsCapped(t *testing.T) {
+	p := newPipeline("bright", "")
+
+	// Every field past the cap is counted as other, however many there are
+	// and however often they are sent.
+	for round := 0; round < 2; round++ {
+		for i := 0; i < maxUnknownFields+50; i++ {
+			p.unknownField("electricity", fmt.Sprintf("electricitymeter.field%d", i))
+		}
+	}
+
+	if got, want := testutil.CollectAndCount(p.unknownFields), maxUnknownFields+1; got != want {
+		t.Errorf("got %d series, want %d", got, want)
+	}
+	if got := testutil.ToFloat64(p.unknownFields.WithLabelValues("electricity", "electricitymeter.field0")); got != 2 {
+		t.Errorf("field0 counted %v times, want 2", got)
+	}
+	if got := testutil.ToFloat64(p.unknownFields.WithLabelValues("electricity", unknownFieldOther)); got != 100 {
+		t.Errorf("other counted %v times, want 100", got)
+	}
+
+	// Fields seen before the cap was reached keep being counted by name.
+	p.unknownField("electricity", "electricitymeter.field1")
+	if got := testutil.ToFloat64(p.unknownFields.WithLabelValues("electricity", "electricitymeter.field1")); got != 3 {
+		t.Errorf("field1 counted %v times, want 3", got)
+	}
+}
+
+func TestTopicsCapped(t *testing.T) {
+	p := newPipeline("bright", "")
+	now := time.Now()
+
+	for i := 0; i < maxTopics+50; i++ {
+		p.received(fmt.Sprintf("glow/device%d/STATE", i), now)
+	}
+	p.received("glow/device0/STATE", now)
+
+	for name, c := range map[string]prometheus.Collector{
+		"messages_received_total":        p.messagesReceived,
+		"last_message_timestamp_seconds": p.lastMessage,
+	} {
+		if got, want := testutil.CollectAndCount(c), maxTopics+1; got != want {
+			t.Errorf("%s: got %d series, want %d", name, got, want)
+		}
+	}
+	if got := testutil.ToFloat64(p.messagesReceived.WithLabelValues("glow/device0/STATE")); got != 2 {
+		t.Errorf("device0 counted %v times, want 2", got)
+	}
+	if got := testutil.ToFloat64(p.messagesReceived.WithLabelValues(topicOther)); got != 50 {
+		t.Errorf("other counted %v times, want 50", got)
+	}
+}
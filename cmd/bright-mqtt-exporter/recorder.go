@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// recording is a single message as written to a recording, one per line.
+type recording struct {
+	Time    time.Time `json:"time"`
+	Topic   string    `json:"topic"`
+	Payload string    `json:"payload"`
+}
+
+// recorder appends every message received to a JSON lines file, to be fed
+// back through the exporter with the replay command. Once the file would grow
+// past maxSize it's rotated, the current file becoming path.1, path.1 becoming
+// path.2 and so on, keeping at most maxFiles old files.
+type recorder struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func newRecorder(c recordConfig) (*recorder, error) {
+	r := &recorder{
+		path:     c.File,
+		maxSize:  int64(c.MaxSizeMB) << 20,
+		maxFiles: c.MaxFiles,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *recorder) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening recording: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("opening recording: %w", err)
+	}
+
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+// record appends a message to the recording. Failures are only logged, as
+// losing a recording shouldn't stop messages being handled.
+func (r *recorder) record(topic string, payload []byte, received time.Time) {
+	line, err := json.Marshal(recording{Time: received, Topic: topic, Payload: string(payload)})
+	if err != nil {
+		log.Errorf("recorder: encoding message on %s: %v", topic, err)
+		return
+	}
+	line = append(line, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.size > 0 && r.size+int64(len(line)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			log.Errorf("recorder: rotating %s: %v", r.path, err)
+		}
+	}
+	if r.f == nil {
+		return
+	}
+
+	n, err := r.f.Write(line)
+	r.size += int64(n)
+	if err != nil {
+		log.Errorf("recorder: writing %s: %v", r.path, err)
+	}
+}
+
+// rotate moves each old file up one place, dropping the oldest, and starts a
+// new file. If the new file can't be opened recording stops until the next
+// rotation is attempted.
+func (r *recorder) rotate() error {
+	if r.f != nil {
+		if err := r.f.Close(); err != nil {
+			log.Warnf("recorder: closing %s: %v", r.path, err)
+		}
+		r.f = nil
+	}
+
+	if err := os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxFiles)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for n := r.maxFiles - 1; n >= 1; n-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", r.path, n), fmt.Sprintf("%s.%d", r.path, n+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if r.maxFiles > 0 {
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+
+	return r.open()
+}
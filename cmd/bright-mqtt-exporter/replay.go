@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	replayCommand = "replay"
+
+	// maxRecordingLine is the longest line a recording may contain, well
+	// beyond any message a dongle sends.
+	maxRecordingLine = 1 << 20
+)
+
+// replay implements the replay command, which feeds recordings made with
+// --record-file back through the same path as live messages and then prints
+// the resulting metrics. It returns the exit code.
+func replay(name string, args []string) int {
+	c := defaultConfig()
+	c.LogLevel = "info"
+	var speed float64
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s: [flags] recording...\n\n", name)
+		fmt.Fprintf(fs.Output(), "Replays recordings made with --record-file, oldest first, and prints the\n")
+		fmt.Fprintf(fs.Output(), "metrics they result in. Give rotated recordings in the order they were\n")
+		fmt.Fprintf(fs.Output(), "written, e.g. messages.jsonl.2 messages.jsonl.1 messages.jsonl.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Float64Var(&speed, "speed", 0, "replay speed relative to the recording, e.g. 1 for real time or 60 for an hour a minute, 0 replays as fast as possible")
+	fs.StringVar(&c.MQTT.MessageFormat, "message-format", c.MQTT.MessageFormat, "message format, auto, local or cloud")
+	fs.StringVar(&c.Metrics.Namespace, "metrics-namespace", c.Metrics.Namespace, "namespace prefixing every metric name")
+	fs.StringVar(&c.Metrics.Subsystem, "metrics-subsystem", c.Metrics.Subsystem, "subsystem prefixing every metric name, after the namespace")
+	fs.StringVar(&c.Metrics.Naming, "metrics-naming", c.Metrics.Naming, "metric naming scheme, conventional, legacy or both")
+	fs.Float64Var(&c.Gas.CalorificValue, "gas-calorific-value", c.Gas.CalorificValue, "gas calorific value in MJ/m3 to compute energy from volume, 0 disables")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "log level, logs are written to stderr")
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	if err := validateReplay(c, speed, fs.NArg()); err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		fs.Usage()
+		return 2
+	}
+
+	level, _ := log.ParseLevel(c.LogLevel)
+	log.SetLevel(level)
+
+	d := Data{
+		readings: newStore(),
+		metrics:  newMetricSet(c.Metrics.Namespace, c.Metrics.Subsystem, c.Metrics.Naming),
+		format:   c.MQTT.MessageFormat,
+		gas:      c.Gas,
+		pipeline: newPipeline(c.Metrics.Namespace, c.Metrics.Subsystem),
+	}
+
+	var prev time.Time
+	for _, path := range fs.Args() {
+		n, err := replayFile(d, path, speed, &prev)
+		if err != nil {
+			log.Error(err)
+			return 1
+		}
+		log.Infof("replayed %d messages from %s", n, path)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(d, d.pipeline)
+	families, err := registry.Gather()
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	enc := expfmt.NewEncoder(os.Stdout, expfmt.FmtText)
+	for _, mf := range families {
+		if err := enc.Encode(mf); err != nil {
+			log.Error(err)
+			return 1
+		}
+	}
+
+	return 0
+}
+
+func validateReplay(c *config, speed float64, recordings int) error {
+	if recordings == 0 {
+		return errors.New("at least one recording must be given")
+	}
+
+	if speed < 0 {
+		return fmt.Errorf("the speed must not be negative, not %v", speed)
+	}
+
+	switch c.MQTT.MessageFormat {
+	case formatAuto, formatLocal, formatCloud:
+	default:
+		return fmt.Errorf("the message format must be one of %s, %s or %s, not %q", formatAuto, formatLocal, formatCloud, c.MQTT.MessageFormat)
+	}
+
+	switch c.Metrics.Naming {
+	case namingConventional, namingLegacy, namingBoth:
+	default:
+		return fmt.Errorf("the metric naming must be one of %s, %s or %s, not %q", namingConventional, namingLegacy, namingBoth, c.Metrics.Naming)
+	}
+
+	if c.Gas.CalorificValue < 0 {
+		return fmt.Errorf("the gas calorific value must not be negative, not %v", c.Gas.CalorificValue)
+	}
+
+	if _, err := log.ParseLevel(c.LogLevel); err != nil {
+		return fmt.Errorf("invalid log level: %w", err)
+	}
+
+	return nil
+}
+
+// replayFile feeds each message in the recording at path to d, returning how
+// many there were. With a non-zero speed it waits between messages for their
+// gap in the recording divided by speed, prev carrying the time of the last
+// message across files.
+func replayFile(d Data, path string, speed float64, prev *time.Time) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("opening recording: %w", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, maxRecordingLine)
+
+	n := 0
+	for line := 1; sc.Scan(); line++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+
+		var r recording
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			return n, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+
+		if speed > 0 && !prev.IsZero() && r.Time.After(*prev) {
+			time.Sleep(time.Duration(float64(r.Time.Sub(*prev)) / speed))
+		}
+		*prev = r.Time
+
+		d.handle(r.Topic, []byte(r.Payload), r.Time)
+		n++
+	}
+	if err := sc.Err(); err != nil {
+		return n, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	bright "github.com/rk295/bright-mqtt-exporter/brightmqtt"
+)
+
+// republisher is a sink which publishes each normalised reading back to the
+// broker as a flat tree of topics holding one plain value each, of the form
+// <prefix>/<device>/<electricity|gas>/<field>, so consumers don't each need
+// to parse the nested Glow JSON.
+type republisher struct {
+	client mqtt.Client
+	prefix string
+	qos    byte
+	retain bool
+}
+
+func newRepublisher(client mqtt.Client, c republishConfig) *republisher {
+	return &republisher{
+		client: client,
+		prefix: c.Prefix,
+		qos:    byte(c.QoS),
+		retain: c.Retain,
+	}
+}
+
+func (p *republisher) write(k meterKey, r bright.Reading) {
+	fields := map[string]string{
+		"import_kwh":       formatValue(r.Import.Cumulative),
+		"import_day_kwh":   formatValue(r.Import.Day),
+		"import_week_kwh":  formatValue(r.Import.Week),
+		"import_month_kwh": formatValue(r.Import.Month),
+		"supplier":         r.Supplier,
+		"timestamp":        r.Timestamp.UTC().Format(time.RFC3339),
+	}
+
+	// Leave the last price published in place rather than publishing zero.
+	if r.Price != nil {
+		fields["unit_rate_gbp_per_kwh"] = formatValue(r.Price.Unitrate)
+		fields["standing_charge_gbp_per_day"] = formatValue(r.Price.StandingCharge)
+	}
+
+	switch r.Kind {
+	case bright.KindElectricity:
+		fields["power_kw"] = formatValue(r.Power)
+		fields["export_kwh"] = formatValue(r.Export.Cumulative)
+		fields["mpan"] = r.MeterID
+	case bright.KindGas:
+		fields["volume_m3"] = formatValue(r.Volume.Cumulative)
+		fields["mprn"] = r.MeterID
+	default:
+		return
+	}
+
+	p.publish(k, string(r.Kind), fields)
+}
+
+// publish publishes each of fields under the meter's topic, waiting for them
+// in the background so the MQTT callback isn't held up.
+func (p *republisher) publish(k meterKey, kind string, fields map[string]string) {
+	tokens := make(map[string]mqtt.Token, len(fields))
+	for field, v := range fields {
+		topic := fmt.Sprintf("%s/%s/%s/%s", p.prefix, topicLevel(k.device), kind, field)
+		tokens[topic] = p.client.Publish(topic, p.qos, p.retain, v)
+	}
+
+	go func() {
+		for topic, token := range tokens {
+			wait(topic, token)
+		}
+	}()
+}
+
+// formatValue formats v with as few digits as represent it exactly, so
+// republished values read the same as those in the original message.
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+
+	bright "github.com/rk295/bright-mqtt-exporter/brightmqtt"
+)
+
+const (
+	simulateCommand = "simulate"
+
+	// simulatedCalorificValue is a typical UK gas calorific value in MJ/m3,
+	// used to derive the simulated gas volume from its energy.
+	simulatedCalorificValue = 39.5
+)
+
+// simulateOptions configures the simulate command.
+type simulateOptions struct {
+	host     string
+	user     string
+	pass     string
+	clientID string
+	listen   string
+
+	prefix   string
+	device   string
+	interval time.Duration
+	gas      bool
+
+	mpan     string
+	mprn     string
+	supplier string
+
+	electricityPrice bright.Price
+	gasPrice         bright.Price
+}
+
+// simulate implements the simulate command, which publishes realistic
+// readings for a made up Glow dongle with an electricity and gas meter, to
+// demo dashboards and test alerting without a real smart meter. It returns
+// the exit code.
+func simulate(name string, args []string) int {
+	o := simulateOptions{}
+	var logLevel string
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s: [flags]\n\n", name)
+		fmt.Fprintf(fs.Output(), "Publishes simulated Glow dongle messages until interrupted. Use --broker\n")
+		fmt.Fprintf(fs.Output(), "to also run a broker to publish to, then point the exporter at it with\n")
+		fmt.Fprintf(fs.Output(), "--mqtt-host tcp://localhost:1883 --mqtt-topic glow/+/SENSOR/+.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&o.host, "mqtt-host", "", "MQTT broker to publish to, defaults to the one started by --broker")
+	fs.StringVar(&o.user, "mqtt-user", "", "MQTT username")
+	fs.StringVar(&o.pass, "mqtt-pass", "", "MQTT password")
+	fs.StringVar(&o.clientID, "mqtt-client-id", "bright-mqtt-simulator", "MQTT client ID")
+	fs.StringVar(&o.listen, "broker", "", "address to run an in-process MQTT broker on, e.g. :1883, for fully offline use")
+	fs.StringVar(&o.prefix, "topic-prefix", "glow", "topic prefix the dongle publishes under")
+	fs.StringVar(&o.device, "device", "SIMULATED0001", "device ID of the simulated dongle")
+	fs.DurationVar(&o.interval, "interval", 10*time.Second, "how often to publish readings")
+	fs.BoolVar(&o.gas, "gas", true, "simulate a gas meter as well as an electricity meter")
+	fs.StringVar(&o.mpan, "mpan", "2000000000001", "MPAN of the simulated electricity meter")
+	fs.StringVar(&o.mprn, "mprn", "1000000001", "MPRN of the simulated gas meter")
+	fs.StringVar(&o.supplier, "supplier", "Simulated Energy", "supplier of the simulated meters")
+	fs.Float64Var(&o.electricityPrice.Unitrate, "electricity-unit-rate", 0.2924, "electricity unit rate in GBP per kWh")
+	fs.Float64Var(&o.electricityPrice.StandingCharge, "electricity-standing-charge", 0.3792, "electricity standing charge in GBP per day")
+	fs.Float64Var(&o.gasPrice.Unitrate, "gas-unit-rate", 0.07344, "gas unit rate in GBP per kWh")
+	fs.Float64Var(&o.gasPrice.StandingCharge, "gas-standing-charge", 0.2722, "gas standing charge in GBP per day")
+	fs.StringVar(&logLevel, "log-level", "info", "log level")
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	level, err := log.ParseLevel(logLevel)
+	if err == nil && o.host == "" && o.listen == "" {
+		err = errors.New("either --mqtt-host or --broker must be given")
+	}
+	if err == nil && o.interval <= 0 {
+		err = fmt.Errorf("the interval must be positive, not %s", o.interval)
+	}
+	if err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		fs.Usage()
+		return 2
+	}
+	log.SetLevel(level)
+
+	if o.listen != "" {
+		b, err := listenEmbeddedBroker(o.listen)
+		if err != nil {
+			log.Error(err)
+			return 1
+		}
+		defer b.close()
+		log.Infof("broker: listening on %s", b.listener.Addr())
+
+		if o.host == "" {
+			o.host = b.url()
+		}
+	}
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(o.host)
+	opts.SetClientID(o.clientID)
+	opts.SetUsername(o.user)
+	opts.SetPassword(o.pass)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(minBackoff)
+	opts.SetMaxReconnectInterval(maxBackoff)
+
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	token.Wait()
+	if err := token.Error(); err != nil {
+		log.Errorf("mqtt: connecting to %s: %v", o.host, err)
+		return 1
+	}
+	defer client.Disconnect(250)
+	log.Infof("mqtt: connected to %s, publishing as device %s every %s", o.host, o.device, o.interval)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	sim := newSimulatedMeters(time.Now(), o)
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+
+	for {
+		o.publish(client, sim)
+
+		select {
+		case <-stop:
+			log.Info("stopping")
+			return 0
+		case now := <-ticker.C:
+			sim.advance(now)
+		}
+	}
+}
+
+// publish sends the simulated meters' current readings, as the dongle would.
+func (o simulateOptions) publish(client mqtt.Client, sim *simulatedMeters) {
+	messages := map[string]interface{}{
+		o.topic(bright.SensorTopic, bright.ElectricityTopic): bright.ElectricitysMsg{Electricitymeter: sim.electricityMeter()},
+		o.topic(bright.StateTopic, ""):                       sim.state(),
+	}
+	if o.gas {
+		messages[o.topic(bright.SensorTopic, bright.GasTopic)] = bright.GasMsg{Gasmeter: sim.gasMeter()}
+	}
+
+	for topic, msg := range messages {
+		payload, err := json.Marshal(msg)
+		if err != nil {
+			log.Errorf("encoding %s: %v", topic, err)
+			continue
+		}
+		if wait(topic, client.Publish(topic, 0, false, payload)) {
+			log.Debugf("mqtt: published to %s", topic)
+		}
+	}
+}
+
+// topic returns the topic the dongle publishes a kind of message on, one of
+// glow/<device>/SENSOR/<meter> or glow/<device>/STATE.
+func (o simulateOptions) topic(kind, meter string) string {
+	if meter == "" {
+		return fmt.Sprintf("%s/%s/%s", o.prefix, o.device, kind)
+	}
+	return fmt.Sprintf("%s/%s/%s/%s", o.prefix, o.device, kind, meter)
+}
+
+// usage is the energy recorded by a meter, the cumulative total and the
+// amount used in the current day, week and month.
+type usage struct {
+	cumulative, day, week, month float64
+}
+
+// add adds kWh to each counter, first resetting any whose period rolled over
+// between from and to, so each resets at midnight, on Monday and on the
+// first of the month.
+func (u *usage) add(kwh float64, from, to time.Time) {
+	fy, fm, fd := from.Date()
+	ty, tm, td := to.Date()
+	// The ISO year can differ from the calendar year around New Year, when
+	// a week spans the two.
+	fwy, fw := from.ISOWeek()
+	twy, tw := to.ISOWeek()
+
+	if fy != ty || fm != tm {
+		u.month = 0
+	}
+	if fwy != twy || fw != tw {
+		u.week = 0
+	}
+	if fy != ty || fm != tm || fd != td {
+		u.day = 0
+	}
+
+	u.cumulative += kwh
+	u.day += kwh
+	u.week += kwh
+	u.month += kwh
+}
+
+// simulatedMeters models a household's electricity and gas use over the day,
+// integrating its demand between readings so the counters are consistent.
+type simulatedMeters struct {
+	opts    simulateOptions
+	rand    *rand.Rand
+	started time.Time
+	now     time.Time
+
+	power       float64
+	electricity usage
+	gas         usage
+}
+
+func newSimulatedMeters(now time.Time, o simulateOptions) *simulatedMeters {
+	s := &simulatedMeters{
+		opts:        o,
+		rand:        rand.New(rand.NewSource(now.UnixNano())),
+		started:     now,
+		now:         now,
+		electricity: usage{cumulative: 4896.645},
+		gas:         usage{cumulative: 12491.78},
+	}
+	s.power = s.electricityDemand(now)
+	return s
+}
+
+// advance moves the simulation on to now.
+func (s *simulatedMeters) advance(now time.Time) {
+	hours := now.Sub(s.now).Hours()
+	if hours <= 0 {
+		return
+	}
+
+	// Use the demand at the midpoint as that over the whole step, which is
+	// close enough for steps of minutes.
+	mid := s.now.Add(now.Sub(s.now) / 2)
+	s.electricity.add(s.electricityDemand(mid)*hours, s.now, now)
+	s.gas.add(s.gasDemand(mid)*hours, s.now, now)
+
+	s.power = s.electricityDemand(now)
+	s.now = now
+}
+
+// electricityDemand returns a typical household's electricity demand in kW
+// at t: a base load with peaks for breakfast, lunch and the evening, noise,
+// and the odd kettle.
+func (s *simulatedMeters) electricityDemand(t time.Time) float64 {
+	h := hourOfDay(t)
+	kw := 0.2 + 0.8*peak(h, 7.5, 1) + 0.3*peak(h, 13, 1.5) + 1.6*peak(h, 18.5, 1.5)
+	kw *= 0.85 + 0.3*s.rand.Float64()
+	if s.rand.Float64() < 0.05 {
+		kw += 2.5
+	}
+	return kw
+}
+
+// gasDemand returns a typical household's gas demand in kW at t, heating in
+// the morning and evening, more so in winter, over a small hot water load.
+func (s *simulatedMeters) gasDemand(t time.Time) float64 {
+	h := hourOfDay(t)
+	winter := 1 + 0.8*math.Cos(2*math.Pi*float64(t.YearDay()-15)/365)
+	kw := 0.3 + winter*(6*peak(h, 7, 1)+5*peak(h, 19, 2))
+	return kw * (0.7 + 0.6*s.rand.Float64())
+}
+
+func (s *simulatedMeters) electricityMeter() bright.ElectricityMeter {
+	m := bright.ElectricityMeter{Timestamp: s.timestamp()}
+	m.Power = bright.Power{Value: round3(s.power), Units: bright.Kilowatts}
+	m.Energy.Export.Units = bright.KilowattHours
+	m.Energy.Import = bright.ElectricityImport{
+		Cumulative: round3(s.electricity.cumulative),
+		Day:        round3(s.electricity.day),
+		Week:       round3(s.electricity.week),
+		Month:      round3(s.electricity.month),
+		Units:      bright.KilowattHours,
+		Mpan:       s.opts.mpan,
+		Supplier:   s.opts.supplier,
+		Price:      s.opts.electricityPrice,
+	}
+	return m
+}
+
+// gasMeter returns the gas meter's reading. Like real dongles, the period
+// "volumes" are sent in kWh and are the same as the period energies.
+func (s *simulatedMeters) gasMeter() bright.GasMeter {
+	m := bright.GasMeter{Timestamp: s.timestamp()}
+	m.Energy.Import = bright.GasImport{
+		Cumulative:           round3(s.gas.cumulative),
+		Day:                  round3(s.gas.day),
+		Week:                 round3(s.gas.week),
+		Month:                round3(s.gas.month),
+		Units:                bright.KilowattHours,
+		Cumulativevol:        round3(s.gas.cumulative / bright.VolumeToEnergy(1, simulatedCalorificValue, bright.StandardCorrectionFactor)),
+		Cumulativevolunits:   bright.CubicMetres,
+		Dayvol:               round3(s.gas.day),
+		Weekvol:              round3(s.gas.week),
+		Monthvol:             round3(s.gas.month),
+		Dayweekmonthvolunits: bright.KilowattHours,
+		Mprn:                 s.opts.mprn,
+		Supplier:             s.opts.supplier,
+		Price:                s.opts.gasPrice,
+	}
+	return m
+}
+
+func (s *simulatedMeters) state() bright.StateMsg {
+	return bright.StateMsg{
+		Software:     "simulated",
+		Timestamp:    s.timestamp(),
+		Hardware:     "GLOW-SIMULATOR",
+		Smetsversion: "SMETS2",
+		Zigbee:       "1.2.5",
+		Uptime:       math.Round(s.now.Sub(s.started).Seconds()),
+		Wifi:         bright.Wifi{Rssi: float64(-60 - s.rand.Intn(6))},
+		Han:          bright.Han{Rssi: float64(-70 - s.rand.Intn(11)), Status: "joined", Lqi: 100},
+	}
+}
+
+// timestamp returns the time of the readings as the dongle sends it, in UTC
+// to the second.
+func (s *simulatedMeters) timestamp() time.Time {
+	return s.now.UTC().Truncate(time.Second)
+}
+
+// peak is a bell curve of height 1 centred on hour centre, width hours wide.
+func peak(hour, centre, width float64) float64 {
+	d := (hour - centre) / width
+	return math.Exp(-d * d / 2)
+}
+
+func hourOfDay(t time.Time) float64 {
+	return float64(t.Hour()) + float64(t.Minute())/60 + float64(t.Second())/3600
+}
+
+// round3 rounds v to the 3 decimal places dongles report.
+func round3(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
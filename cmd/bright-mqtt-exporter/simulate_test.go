@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUsageAdd(t *testing.T) {
+	at := func(year int, month time.Month, day, hour int) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name     string
+		from, to time.Time
+		want     usage
+	}{
+		{
+			name: "same day",
+			from: at(2022, time.August, 25, 10),
+			to:   at(2022, time.August, 25, 11),
+			want: usage{cumulative: 100.5, day: 1.5, week: 2.5, month: 3.5},
+		},
+		{
+			name: "next day",
+			from: at(2022, time.August, 25, 23),
+			to:   at(2022, time.August, 26, 0),
+			want: usage{cumulative: 100.5, day: 0.5, week: 2.5, month: 3.5},
+		},
+		{
+			// Sunday to Monday.
+			name: "next week",
+			from: at(2022, time.August, 28, 23),
+			to:   at(2022, time.August, 29, 0),
+			want: usage{cumulative: 100.5, day: 0.5, week: 0.5, month: 3.5},
+		},
+		{
+			// Wednesday to Thursday.
+			name: "next month",
+			from: at(2022, time.August, 31, 23),
+			to:   at(2022, time.September, 1, 0),
+			want: usage{cumulative: 100.5, day: 0.5, week: 2.5, month: 0.5},
+		},
+		{
+			// Thursday to Friday, both in week 53 of 2020.
+			name: "next year, same week",
+			from: at(2020, time.December, 31, 23),
+			to:   at(2021, time.January, 1, 0),
+			want: usage{cumulative: 100.5, day: 0.5, week: 2.5, month: 0.5},
+		},
+		{
+			// Sunday to Monday.
+			name: "next year and week",
+			from: at(2023, time.December, 31, 23),
+			to:   at(2024, time.January, 1, 0),
+			want: usage{cumulative: 100.5, day: 0.5, week: 0.5, month: 0.5},
+		},
+		{
+			// Wednesday of week 34 in both years.
+			name: "same week a year later",
+			from: at(2021, time.August, 25, 10),
+			to:   at(2022, time.August, 24, 10),
+			want: usage{cumulative: 100.5, day: 0.5, week: 0.5, month: 0.5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := usage{cumulative: 100, day: 1, week: 2, month: 3}
+			u.add(0.5, tt.from, tt.to)
+			if u != tt.want {
+				t.Errorf("got %+v, want %+v", u, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,12 @@
+package main
+
+import (
+	bright "github.com/rk295/bright-mqtt-exporter/brightmqtt"
+)
+
+// sink receives every meter reading once it has been stored, to forward it
+// somewhere other than the metrics endpoint. Sinks are called from the MQTT
+// callback goroutine, so must not block for long.
+type sink interface {
+	write(k meterKey, r bright.Reading)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"sync"
+	"time"
+	_ "time/tzdata"
+
+	bright "github.com/rk295/bright-mqtt-exporter/brightmqtt"
+)
+
+// store holds the latest message received for each meter. It is written from
+// the MQTT callback goroutine and read concurrently whenever Prometheus
+// scrapes us, so every access goes through the lock.
+type store struct {
+	mu          sync.RWMutex
+	electricity map[meterKey]bright.Reading
+	gas         map[meterKey]bright.Reading
+
+	electricityCost map[meterKey]*meterCost
+	gasCost         map[meterKey]*meterCost
+
+	// states is the last state message from each dongle, keyed by device.
+	states map[string]bright.StateMsg
+
+	// received is when the last meter reading was stored.
+	received time.Time
+}
+
+// snapshot is a point in time copy of a store, safe to read without holding
+// any locks.
+type snapshot struct {
+	electricity map[meterKey]bright.Reading
+	gas         map[meterKey]bright.Reading
+
+	electricityCost map[meterKey]meterCost
+	gasCost         map[meterKey]meterCost
+
+	states map[string]bright.StateMsg
+}
+
+// meterCost is the running cost of a single meter. It is built up as each
+// reading arrives, charging the energy used since the previous reading at the
+// unit rate which was in force at that previous reading, so a tariff change
+// part way through the day only applies to energy used after it.
+type meterCost struct {
+	// total is the cost of all energy used since the exporter started,
+	// excluding standing charges.
+	total float64
+
+	// usedToday is the cost of energy used so far today and today is the
+	// standing charge pro-rated to the time of the last reading plus
+	// usedToday.
+	usedToday float64
+	today     float64
+
+	day            time.Time
+	last           time.Time
+	cumulative     float64
+	unitRate       float64
+	standingCharge float64
+	seen           bool
+
+	// priced is true once a reading with a price has been seen. Until then
+	// the cost is unknown, rather than zero.
+	priced bool
+}
+
+func newStore() *store {
+	return &store{
+		electricity:     make(map[meterKey]bright.Reading),
+		gas:             make(map[meterKey]bright.Reading),
+		electricityCost: make(map[meterKey]*meterCost),
+		gasCost:         make(map[meterKey]*meterCost),
+		states:          make(map[string]bright.StateMsg),
+	}
+}
+
+// set stores a reading from the electricity or gas meter k.
+func (s *store) set(k meterKey, r bright.Reading) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Kind {
+	case bright.KindElectricity:
+		s.electricity[k] = r
+		updateCost(s.electricityCost, k, r.Timestamp, r.Import.Cumulative, r.Price)
+	case bright.KindGas:
+		s.gas[k] = r
+		updateCost(s.gasCost, k, r.Timestamp, r.Import.Cumulative, r.Price)
+	default:
+		return
+	}
+	s.received = time.Now()
+}
+
+func (s *store) setState(device string, m bright.StateMsg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.states[device] = m
+}
+
+// lastReceived returns when the last meter reading was stored, or the zero
+// time if there hasn't been one.
+func (s *store) lastReceived() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.received
+}
+
+// costLocation is the time zone days are costed in. Suppliers bill by the day
+// in Great Britain, wherever the exporter runs, so this doesn't follow the
+// local time zone, which is usually UTC in a container.
+var costLocation = mustLoadLocation("Europe/London")
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
+// updateCost adds the cost of the energy used since the last reading to the
+// running cost of the meter k in costs. A reading without a price leaves the
+// last price seen in force.
+func updateCost(costs map[meterKey]*meterCost, k meterKey, ts time.Time, cumulative float64, p *bright.Price) {
+	c, ok := costs[k]
+	if !ok {
+		c = &meterCost{}
+		costs[k] = c
+	}
+
+	ts = ts.In(costLocation)
+	day := time.Date(ts.Year(), ts.Month(), ts.Day(), 0, 0, 0, 0, ts.Location())
+
+	// The first reading only sets the baseline, as is a reading where the
+	// meter appears to have gone backwards (e.g. after being replaced).
+	var cost float64
+	if c.seen && c.priced && cumulative > c.cumulative {
+		cost = (cumulative - c.cumulative) * c.unitRate
+		c.total += cost
+	}
+
+	if !day.Equal(c.day) {
+		// Some of the energy used since a reading before midnight was used
+		// yesterday, so only charge today with the share used since
+		// midnight, assuming it was used at a steady rate.
+		if c.seen && c.last.Before(day) {
+			cost *= ts.Sub(day).Seconds() / ts.Sub(c.last).Seconds()
+		}
+		c.usedToday = 0
+		c.day = day
+	}
+	c.usedToday += cost
+
+	if p != nil {
+		c.unitRate = p.Unitrate
+		c.standingCharge = p.StandingCharge
+		c.priced = true
+	}
+
+	elapsed := ts.Sub(day).Hours() / 24
+	c.today = c.usedToday + c.standingCharge*elapsed
+
+	c.cumulative = cumulative
+	c.last = ts
+	c.seen = true
+}
+
+// snapshot returns a consistent copy of every meter in the store.
+func (s *store) snapshot() snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snap := snapshot{
+		electricity: make(map[meterKey]bright.Reading, len(s.electricity)),
+		gas:         make(map[meterKey]bright.Reading, len(s.gas)),
+
+		electricityCost: make(map[meterKey]meterCost, len(s.electricityCost)),
+		gasCost:         make(map[meterKey]meterCost, len(s.gasCost)),
+
+		states: make(map[string]bright.StateMsg, len(s.states)),
+	}
+	for k, m := range s.electricity {
+		snap.electricity[k] = m
+	}
+	for k, m := range s.gas {
+		snap.gas[k] = m
+	}
+	for k, c := range s.electricityCost {
+		snap.electricityCost[k] = *c
+	}
+	for k, c := range s.gasCost {
+		snap.gasCost[k] = *c
+	}
+	for device, m := range s.states {
+		snap.states[device] = m
+	}
+
+	return snap
+}
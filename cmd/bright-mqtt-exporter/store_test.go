@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	bright "github.com/rk295/bright-mqtt-exporter/brightmqtt"
+)
+
+// TestStoreConcurrentAccess writes and reads the store from several
+// goroutines at once, as the MQTT callback and Prometheus scrapes do. It
+// only fails under go test -race.
+func TestStoreConcurrentAccess(t *testing.T) {
+	d := Data{
+		readings: newStore(),
+		metrics:  newMetricSet("bright", "", namingBoth),
+		gas:      gasConfig{CalorificValue: 39.5, CorrectionFactor: bright.StandardCorrectionFactor},
+	}
+
+	const writers, iterations = 4, 200
+	var wg sync.WaitGroup
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			device := fmt.Sprintf("device%d", w%2)
+			for i := 0; i < iterations; i++ {
+				ts := time.Now()
+				d.readings.set(meterKey{device, "mpan"}, bright.Reading{
+					Kind:      bright.KindElectricity,
+					Device:    device,
+					Timestamp: ts,
+					MeterID:   "mpan",
+					Import:    bright.Usage{Cumulative: float64(i)},
+					Price:     &bright.Price{Unitrate: 0.3, StandingCharge: 0.5},
+				})
+				d.readings.set(meterKey{device, "mprn"}, bright.Reading{
+					Kind:      bright.KindGas,
+					Device:    device,
+					Timestamp: ts,
+					MeterID:   "mprn",
+					Import:    bright.Usage{Cumulative: float64(i)},
+					Volume:    bright.Usage{Cumulative: float64(i) / 10},
+				})
+				d.readings.setState(device, bright.StateMsg{Software: "v1.8.12", Timestamp: ts})
+			}
+		}(w)
+	}
+
+	for r := 0; r < writers; r++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				snap := d.readings.snapshot()
+				for range snap.electricity {
+				}
+				d.readings.lastReceived()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations/10; i++ {
+				ch := make(chan prometheus.Metric)
+				go func() {
+					d.Collect(ch)
+					close(ch)
+				}()
+				for range ch {
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	snap := d.readings.snapshot()
+	if len(snap.electricity) != 2 || len(snap.gas) != 2 || len(snap.states) != 2 {
+		t.Errorf("got %d electricity, %d gas meters and %d states, want 2 of each",
+			len(snap.electricity), len(snap.gas), len(snap.states))
+	}
+}
+
+// costReading is a single reading fed to updateCost.
+type costReading struct {
+	ts         time.Time
+	cumulative float64
+	price      *bright.Price
+}
+
+func TestUpdateCost(t *testing.T) {
+	at := func(day, hour int) time.Time {
+		return time.Date(2022, 8, day, hour, 0, 0, 0, costLocation)
+	}
+	price := func(unitRate, standingCharge float64) *bright.Price {
+		return &bright.Price{Unitrate: unitRate, StandingCharge: standingCharge}
+	}
+
+	tests := []struct {
+		name      string
+		readings  []costReading
+		total     float64
+		usedToday float64
+		today     float64
+		priced    bool
+	}{
+		{
+			name: "tariff change mid-day",
+			readings: []costReading{
+				{at(25, 10), 100, price(0.30, 0.48)},
+				// The energy used up to the change is charged at the old rate.
+				{at(25, 11), 102, price(0.50, 0.48)},
+				{at(25, 12), 105, price(0.50, 0.48)},
+				// A reading without a price leaves the last one in force.
+				{at(25, 18), 106, nil},
+			},
+			total:     2*0.30 + 3*0.50 + 1*0.50,
+			usedToday: 2*0.30 + 3*0.50 + 1*0.50,
+			today:     2*0.30 + 3*0.50 + 1*0.50 + 0.48*18/24,
+			priced:    true,
+		},
+		{
+			name: "day rollover",
+			readings: []costReading{
+				{at(25, 20), 90, price(0.20, 0.48)},
+				{at(25, 23), 100, price(0.20, 0.48)},
+				// Half the energy since 23:00 was used before midnight.
+				{at(26, 1), 110, price(0.20, 0.48)},
+			},
+			total:     20 * 0.20,
+			usedToday: 5 * 0.20,
+			today:     5*0.20 + 0.48*1/24,
+			priced:    true,
+		},
+		{
+			// Readings are timestamped in UTC, but the day starts at
+			// midnight in London, 23:00 UTC in summer.
+			name: "day rollover in BST",
+			readings: []costReading{
+				{time.Date(2022, 8, 25, 22, 30, 0, 0, time.UTC), 100, price(0.20, 0.48)},
+				{time.Date(2022, 8, 25, 23, 30, 0, 0, time.UTC), 110, price(0.20, 0.48)},
+			},
+			total:     10 * 0.20,
+			usedToday: 5 * 0.20,
+			today:     5*0.20 + 0.48*0.5/24,
+			priced:    true,
+		},
+		{
+			name: "no price",
+			readings: []costReading{
+				{at(25, 10), 100, nil},
+				{at(25, 11), 102, nil},
+			},
+		},
+		{
+			name: "meter replaced",
+			readings: []costReading{
+				{at(25, 10), 100, price(0.30, 0.48)},
+				{at(25, 11), 2, price(0.30, 0.48)},
+				{at(25, 12), 4, price(0.30, 0.48)},
+			},
+			total:     2 * 0.30,
+			usedToday: 2 * 0.30,
+			today:     2*0.30 + 0.48*12/24,
+			priced:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := meterKey{"device", "mpan"}
+			costs := make(map[meterKey]*meterCost)
+			for _, r := range tt.readings {
+				updateCost(costs, k, r.ts, r.cumulative, r.price)
+			}
+
+			c := costs[k]
+			if c.priced != tt.priced {
+				t.Errorf("priced = %v, want %v", c.priced, tt.priced)
+			}
+			for _, v := range []struct {
+				name      string
+				got, want float64
+			}{
+				{"total", c.total, tt.total},
+				{"usedToday", c.usedToday, tt.usedToday},
+				{"today", c.today, tt.today},
+			} {
+				if math.Abs(v.got-v.want) > 1e-9 {
+					t.Errorf("%s = %v, want %v", v.name, v.got, v.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/certifi/gocertifi"
+)
+
+// tlsVersions maps the min_version config setting to its tls package value.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsConfig configures the TLS connection to an ssl://, tls:// or wss://
+// broker. It is ignored for plain tcp:// and ws:// brokers.
+type tlsConfig struct {
+	// CAFile is a PEM bundle of CAs to trust, if unset the Mozilla CA bundle
+	// from gocertifi is used.
+	CAFile string `yaml:"ca_file"`
+
+	// CertFile and KeyFile are a PEM client certificate and key, for brokers
+	// which require mutual TLS.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+
+	// ServerName overrides the name used for SNI and to verify the broker's
+	// certificate.
+	ServerName string `yaml:"server_name"`
+
+	// InsecureSkipVerify disables verification of the broker's certificate,
+	// only use it for testing.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+
+	// MinVersion is the lowest TLS version to accept, one of 1.0, 1.1, 1.2 or
+	// 1.3.
+	MinVersion string `yaml:"min_version"`
+}
+
+// validate checks the settings which can be checked without reading any of
+// the files.
+func (c tlsConfig) validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("the MQTT TLS client certificate and key must be set together")
+	}
+
+	if _, ok := tlsVersions[c.MinVersion]; !ok {
+		return fmt.Errorf("the MQTT TLS min version must be one of 1.0, 1.1, 1.2 or 1.3, not %q", c.MinVersion)
+	}
+
+	return nil
+}
+
+// build loads the CA bundle and client certificate and returns the resulting
+// TLS config.
+func (c tlsConfig) build() (*tls.Config, error) {
+	t := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		MinVersion:         tlsVersions[c.MinVersion],
+	}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading MQTT CA bundle: %w", err)
+		}
+		t.RootCAs = x509.NewCertPool()
+		if !t.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in MQTT CA bundle %s", c.CAFile)
+		}
+	} else {
+		pool, err := gocertifi.CACerts()
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize root CA pool: %w", err)
+		}
+		t.RootCAs = pool
+	}
+
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading MQTT client certificate: %w", err)
+		}
+		t.Certificates = []tls.Certificate{cert}
+	}
+
+	return t, nil
+}